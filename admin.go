@@ -0,0 +1,515 @@
+package cowallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/twitchtv/twirp"
+)
+
+// requireAdmin 只允许配置的管理员访问
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFrom(r.Context())
+		if !ok {
+			renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+			return
+		}
+
+		if !govalidator.IsIn(user.MixinID, s.cfg.Admins...) {
+			renderErr(w, twirp.PermissionDenied.Error("permission denied"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GrantRenew 手动授予或延长订阅，从当前到期时间（已过期则从现在）开始计算
+func GrantRenew(db *badger.DB, members []string, threshold uint8, period time.Duration, reason, operator string) (*Renew, error) {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+
+	r, err := grantRenew(txn, members, threshold, period, reason, operator)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, txn.Commit()
+}
+
+func grantRenew(txn *badger.Txn, members []string, threshold uint8, period time.Duration, reason, operator string) (*Renew, error) {
+	from, seq, err := getVaultExpiredAt(txn, members, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	from = maxDate(from, now)
+
+	// 沿用上一次续费的 sequence，不影响之后付款的续费判断
+	r := &Renew{
+		ID:        uuid.New(),
+		Sequence:  seq,
+		CreatedAt: now,
+		Members:   members,
+		Threshold: threshold,
+		Period:    int64(period / time.Second),
+		From:      from,
+		To:        from.Add(period),
+		Reason:    reason,
+		Operator:  operator,
+	}
+
+	if err := saveRenew(txn, r); err != nil {
+		return nil, err
+	}
+
+	if err := enqueueWebhookEvent(txn, r.Members, r.Threshold, WebhookEventVaultRenewed, r); err != nil {
+		return nil, err
+	}
+
+	if err := saveJobIfNotExist(txn, members, threshold); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// hasSyncCredential vault 是否有带着成员有效授权的同步任务
+func hasSyncCredential(txn *badger.Txn, members []string, threshold uint8) (bool, error) {
+	job, err := findJob(txn, members, threshold)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if job.User == nil {
+		return false, nil
+	}
+
+	credential, err := findCredential(txn, uuid.MustParse(job.User.MixinID))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return !credential.Expired(), nil
+}
+
+// ResetVault 把 vault 的同步位置重置为 offset，并清空同步计划的退避让同步任务立即执行，vault 不存在时返回 badger.ErrKeyNotFound；
+// 没有带着成员有效授权的同步任务时同样会重置，credential 返回 false，schedule 标记 CredentialMissing，等成员重新登录后才会真正同步
+func ResetVault(db *badger.DB, members []string, threshold uint8, offset uint64) (_ *Vault, credential bool, _ error) {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+
+	vault, err := findSavedVault(txn, members, threshold)
+	if err != nil {
+		return nil, false, err
+	}
+
+	credential, err = hasSyncCredential(txn, members, threshold)
+	if err != nil {
+		return nil, false, err
+	}
+
+	vault.Offset = offset
+	vault.UpdatedAt = time.Time{}
+	if err := saveVault(txn, vault); err != nil {
+		return nil, false, err
+	}
+
+	schedule, err := findSchedule(txn, members, threshold)
+	if err != nil {
+		return nil, false, err
+	}
+
+	schedule.NextRunAt = time.Time{}
+	schedule.Failures = 0
+	schedule.LastError = ""
+	schedule.CredentialMissing = !credential
+	if err := saveSchedule(txn, schedule); err != nil {
+		return nil, false, err
+	}
+
+	return vault, credential, txn.Commit()
+}
+
+// saveJobIfNotExist 已有的任务里带着用户的授权，不能覆盖
+func saveJobIfNotExist(txn *badger.Txn, members []string, threshold uint8) error {
+	if _, err := findJob(txn, members, threshold); err == nil {
+		return nil
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+
+	return saveJob(txn, &Job{
+		CreatedAt: time.Now(),
+		Members:   members,
+		Threshold: threshold,
+	}, time.Minute)
+}
+
+// DeleteJob 删除同步任务和它的同步计划
+func DeleteJob(db *badger.DB, members []string, threshold uint8) error {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+
+	if err := deleteJob(txn, members, threshold); err != nil {
+		return err
+	}
+
+	if err := deleteSchedule(txn, members, threshold); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func parseAdminVault(r *http.Request) (*mixin.MixAddress, error) {
+	addr, err := mixin.MixAddressFromString(chi.URLParam(r, "addr"))
+	if err != nil {
+		return nil, twirp.InvalidArgumentError("addr", "invalid")
+	}
+
+	return addr, nil
+}
+
+type AdminVaultView struct {
+	*Vault
+
+	ExpiredAt    time.Time  `json:"expired_at"`
+	JobExpiredAt *time.Time `json:"job_expired_at,omitempty"`
+	Schedule     *Schedule  `json:"schedule"` // 下次同步时间、连续失败次数和最后一次错误
+}
+
+func adminVaultView(txn *badger.Txn, v *Vault) (*AdminVaultView, error) {
+	expiredAt, _, err := getVaultExpiredAt(txn, v.Members, v.Threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &AdminVaultView{Vault: v, ExpiredAt: expiredAt}
+
+	jobExpiredAt, err := findJobExpiredAt(txn, v.Members, v.Threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if !jobExpiredAt.IsZero() {
+		view.JobExpiredAt = &jobExpiredAt
+	}
+
+	if view.Schedule, err = findSchedule(txn, v.Members, v.Threshold); err != nil {
+		return nil, err
+	}
+
+	return view, nil
+}
+
+func (s *Server) adminListVaults(w http.ResponseWriter, r *http.Request) {
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	vaults, err := listAllVaults(txn)
+	if err != nil {
+		slog.Error("listAllVaults", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	views := []*AdminVaultView{}
+	for _, v := range vaults {
+		view, err := adminVaultView(txn, v)
+		if err != nil {
+			renderErr(w, err)
+			return
+		}
+
+		views = append(views, view)
+	}
+
+	renderJSON(w, views)
+}
+
+func (s *Server) adminFindVault(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAdminVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	vault, err := findSavedVault(txn, addr.Members(), addr.Threshold)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			renderErr(w, twirp.NotFoundError("vault not found"))
+			return
+		}
+
+		renderErr(w, err)
+		return
+	}
+
+	view, err := adminVaultView(txn, vault)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, view)
+}
+
+// MaxGrantDays 手动授予的天数上限，避免换算成 time.Duration 时溢出
+const MaxGrantDays = 3650
+
+func (s *Server) adminGrantRenew(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAdminVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	var body struct {
+		Days   int    `json:"days"`
+		Reason string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	if body.Days <= 0 || body.Days > MaxGrantDays {
+		renderErr(w, twirp.InvalidArgumentError("days", fmt.Sprintf("must be between 1 and %d", MaxGrantDays)))
+		return
+	}
+
+	if body.Reason = strings.TrimSpace(body.Reason); body.Reason == "" {
+		renderErr(w, twirp.RequiredArgumentError("reason"))
+		return
+	}
+
+	user, _ := UserFrom(r.Context())
+	period := time.Duration(body.Days) * 24 * time.Hour
+	renew, err := GrantRenew(s.db, addr.Members(), addr.Threshold, period, body.Reason, user.MixinID)
+	if err != nil {
+		slog.Error("GrantRenew", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	slog.Info("grant renew", "addr", addr.String(), "to", renew.To, "operator", user.MixinID, "reason", body.Reason)
+	renderJSON(w, renew)
+}
+
+func (s *Server) adminResyncVault(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAdminVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	// body 可以为空，默认从头同步
+	var body struct {
+		Offset uint64 `json:"offset"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	vault, credential, err := ResetVault(s.db, addr.Members(), addr.Threshold, body.Offset)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			renderErr(w, twirp.NotFoundError("vault not found"))
+			return
+		}
+
+		slog.Error("ResetVault", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	if !credential {
+		slog.Info("resync vault without sync credential", "addr", addr.String())
+	}
+
+	// schedule.credential_missing 为 true 时需要有成员重新登录后才会真正同步
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	view, err := adminVaultView(txn, vault)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, view)
+}
+
+type AdminJobView struct {
+	*Job
+
+	ExpiredAt time.Time `json:"expired_at"`
+	Schedule  *Schedule `json:"schedule"`
+}
+
+func (s *Server) adminListJobs(w http.ResponseWriter, r *http.Request) {
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	jobs, err := listJobs(txn)
+	if err != nil {
+		slog.Error("listJobs", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	views := []*AdminJobView{}
+	for _, job := range jobs {
+		expiredAt, err := findJobExpiredAt(txn, job.Members, job.Threshold)
+		if err != nil {
+			renderErr(w, err)
+			return
+		}
+
+		schedule, err := findSchedule(txn, job.Members, job.Threshold)
+		if err != nil {
+			renderErr(w, err)
+			return
+		}
+
+		// 不返回用户的授权
+		job.User = nil
+		views = append(views, &AdminJobView{Job: job, ExpiredAt: expiredAt, Schedule: schedule})
+	}
+
+	renderJSON(w, views)
+}
+
+func (s *Server) adminDeleteJob(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAdminVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	if err := DeleteJob(s.db, addr.Members(), addr.Threshold); err != nil {
+		slog.Error("DeleteJob", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminReadProperty(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	var v json.RawMessage
+	if err := ReadProperty(s.db, key, &v); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	if len(v) == 0 {
+		renderErr(w, twirp.NotFoundError("property not found"))
+		return
+	}
+
+	renderJSON(w, map[string]any{
+		"key":   key,
+		"value": v,
+	})
+}
+
+func (s *Server) adminSaveProperty(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+
+	var v json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid json"))
+		return
+	}
+
+	if err := SaveProperty(s.db, key, v); err != nil {
+		slog.Error("SaveProperty", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	user, _ := UserFrom(r.Context())
+	slog.Info("save property", "key", key, "operator", user.MixinID)
+
+	renderJSON(w, map[string]any{
+		"key":   key,
+		"value": v,
+	})
+}
+
+func (s *Server) adminListBackups(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.BackupDir == "" {
+		renderErr(w, twirp.FailedPrecondition.Error("backup dir not configured"))
+		return
+	}
+
+	backups, err := ListBackups(s.cfg.BackupDir)
+	if err != nil {
+		slog.Error("ListBackups", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	if backups == nil {
+		backups = []*BackupInfo{}
+	}
+
+	renderJSON(w, backups)
+}
+
+func (s *Server) adminBackup(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.BackupDir == "" {
+		renderErr(w, twirp.FailedPrecondition.Error("backup dir not configured"))
+		return
+	}
+
+	// body 可以为空，默认做全量备份
+	var body struct {
+		Incremental bool `json:"incremental"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	b, err := Backup(s.db, s.cfg.BackupDir, body.Incremental)
+	if err != nil {
+		slog.Error("Backup", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, b)
+}
@@ -0,0 +1,251 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+func TestAdmin(t *testing.T) {
+	db := newTestDB(t)
+
+	s := &Server{db: db, cfg: Config{Admins: []string{"a0b8d5ee-7f12-4c63-9f6e-1a8c3d1e2b4f"}}}
+	handler := s.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for user, code := range map[string]int{
+		"":                                     http.StatusUnauthorized,
+		"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d": http.StatusForbidden,
+		"a0b8d5ee-7f12-4c63-9f6e-1a8c3d1e2b4f": http.StatusNoContent,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/vaults", nil)
+		if user != "" {
+			r = r.WithContext(WithUser(r.Context(), &User{MixinID: user}))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("user %q: want status %d, got %d", user, code, w.Code)
+		}
+	}
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		day       = 24 * time.Hour
+	)
+
+	first, err := GrantRenew(db, members, threshold, 7*day, "beta tester", s.cfg.Admins[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 还没有保存过的 vault 查不到，也不能重新同步
+	unknown := mixin.RequireNewMixAddress([]string{"8017d200-7870-4b82-b53f-74bae1d2dad7"}, 1).String()
+	if w := serveAs(s.adminFindVault, "/admin/vaults/{addr}", s.cfg.Admins[0], "/admin/vaults/"+unknown); w.Code != http.StatusNotFound {
+		t.Fatalf("want not found, got %d", w.Code)
+	}
+
+	if _, _, err := ResetVault(db, members, threshold, 0); !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("want ErrKeyNotFound, got %v", err)
+	}
+
+	// 第二次授予从上一次的到期时间开始
+	second, err := GrantRenew(db, members, threshold, 3*day, "compensation", s.cfg.Admins[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.From.Equal(first.To) || !second.To.Equal(first.To.Add(3*day)) {
+		t.Fatalf("unexpected renew period %s - %s", second.From, second.To)
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveVault(txn, &Vault{Members: members, Threshold: threshold, Offset: 100, UpdatedAt: time.Now()})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveSchedule(txn, &Schedule{Members: members, Threshold: threshold, Failures: 3, LastError: "timeout"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteJob(db, members, threshold); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除任务时一起删除同步计划
+	if schedule, err := FindSchedule(db, members, threshold); err != nil || schedule.Failures != 0 {
+		t.Fatalf("schedule not deleted: %+v %v", schedule, err)
+	}
+
+	reset := func(credential bool) *Vault {
+		t.Helper()
+
+		vault, ok, err := ResetVault(db, members, threshold, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schedule, err := FindSchedule(db, members, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != credential || schedule.CredentialMissing == credential || !schedule.NextRunAt.IsZero() || schedule.Failures != 0 {
+			t.Fatalf("want credential %v, got %v with schedule %+v", credential, ok, schedule)
+		}
+
+		if vault.Offset != 0 {
+			t.Fatalf("want offset reset, got %d", vault.Offset)
+		}
+
+		return vault
+	}
+
+	// 没有带授权的任务时同样重置同步位置，并标记缺少授权
+	reset(false)
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := saveJob(txn, &Job{CreatedAt: time.Now(), User: &User{MixinID: members[0]}, Members: members, Threshold: threshold}, time.Hour); err != nil {
+			return err
+		}
+
+		return saveSchedule(txn, &Schedule{Members: members, Threshold: threshold, NextRunAt: time.Now().Add(time.Hour), Failures: 5})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 任务带着用户但是没有保存授权，或者授权已经过期
+	reset(false)
+
+	saveCredentialAt := func(expiredAt time.Time) {
+		if err := db.Update(func(txn *badger.Txn) error {
+			return saveCredential(txn, &Credential{UserID: uuid.MustParse(members[0]), Sealed: "sealed", ExpiredAt: expiredAt})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saveCredentialAt(time.Now().Add(-time.Minute))
+	reset(false)
+
+	saveCredentialAt(time.Now().Add(time.Hour))
+	reset(true)
+
+	// 重置之后的下一轮就会执行同步，这里保存的授权无法解密，所以同步会失败并记录下来
+	srv := newTestServer(t, db, Config{})
+	_ = srv.handlePendingJobs(context.Background())
+
+	schedule, err := FindSchedule(db, members, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schedule.LastRunAt.IsZero() || schedule.Failures != 1 || schedule.LastError == "" {
+		t.Fatalf("want sync to run after reset, got %+v", schedule)
+	}
+}
+
+func TestVaultExpiredAt(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		now       = time.Now()
+		day       = 24 * time.Hour
+	)
+
+	granted, err := GrantRenew(db, members, threshold, 30*day, "beta tester", "a0b8d5ee-7f12-4c63-9f6e-1a8c3d1e2b4f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 之后才处理的付款，output 的时间早于手动授予
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveRenew(txn, &Renew{
+			ID:        uuid.New(),
+			CreatedAt: now.Add(-time.Hour),
+			Sequence:  10,
+			Members:   members,
+			Threshold: threshold,
+			From:      now.Add(-time.Hour),
+			To:        now.Add(-time.Hour + 7*day),
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		expiredAt, seq, err := getVaultExpiredAt(txn, members, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !expiredAt.Equal(granted.To) || seq != 10 {
+			t.Fatalf("want %s and sequence 10, got %s and %d", granted.To, expiredAt, seq)
+		}
+	}
+
+	check()
+
+	// 升级之前没有保存到期时间，migration 根据续费记录补上
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(buildIndexKey(renewExpiryPrefix, hashMembers(members, threshold)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := backfillVaultExpiry(context.Background(), db, false); err != nil || n != 1 {
+		t.Fatalf("want 1 vault backfilled, got %d %v", n, err)
+	}
+
+	check()
+}
+
+func TestAdminGrantRenewDays(t *testing.T) {
+	db := newTestDB(t)
+
+	const admin = "a0b8d5ee-7f12-4c63-9f6e-1a8c3d1e2b4f"
+	s := &Server{db: db, cfg: Config{Admins: []string{admin}}}
+	addr := mixin.RequireNewMixAddress([]string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}, 1).String()
+
+	m := chi.NewMux()
+	m.Post("/admin/vaults/{addr}/renewals", s.adminGrantRenew)
+
+	for days, code := range map[int]int{
+		0:                http.StatusBadRequest,
+		MaxGrantDays + 1: http.StatusBadRequest,
+		// 换算成 time.Duration 会溢出
+		1 << 40:      http.StatusBadRequest,
+		MaxGrantDays: http.StatusOK,
+	} {
+		body := strings.NewReader(fmt.Sprintf(`{"days":%d,"reason":"compensation"}`, days))
+		r := httptest.NewRequest(http.MethodPost, "/admin/vaults/"+addr+"/renewals", body)
+		r = r.WithContext(WithUser(r.Context(), &User{MixinID: admin}))
+
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("days %d: want status %d, got %d", days, code, w.Code)
+		}
+	}
+}
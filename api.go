@@ -3,6 +3,8 @@ package cowallet
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -16,6 +18,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 	"github.com/rs/cors"
+	"github.com/shopspring/decimal"
 	"github.com/spf13/cast"
 	"github.com/twitchtv/twirp"
 	"github.com/yiplee/go-cache"
@@ -25,22 +28,54 @@ func (s *Server) Handler() http.Handler {
 	m := chi.NewMux()
 	m.Use(middleware.Recoverer)
 	m.Use(middleware.RealIP)
+	m.Use(handleMetrics)
 	m.Use(middleware.Logger)
 	m.Use(middleware.Heartbeat("/hc"))
 	m.Use(cors.AllowAll().Handler)
-	m.Use(handleAuth())
+	m.Use(s.handleAuth())
 
 	m.Get("/info", s.getSystemInfo)
+	m.Get("/plans/{id}", s.listPlanVersions)
+
+	m.Route("/auth", func(r chi.Router) {
+		r.Post("/login", s.login)
+		r.Post("/refresh", s.refresh)
+		r.Post("/logout", s.logout)
+		r.Delete("/credential", s.revokeCredential)
+	})
 
 	m.Route("/vaults", func(r chi.Router) {
 		r.Get("/", s.listVaults)
 		r.Get("/{addr}", s.findVault)
 		r.Put("/{addr}", s.updateVault)
+		r.Get("/{addr}/requests", s.listRequests)
+		r.Post("/{addr}/requests", s.createRequest)
+		r.Get("/{addr}/requests/{id}", s.findRequest)
+		r.Get("/{addr}/renewals", s.listRenewals)
+		r.Get("/{addr}/schedule", s.findSchedule)
+		r.Get("/{addr}/events", s.streamVaultEvents)
+		r.Get("/{addr}/balances", s.getBalances)
+		r.Get("/{addr}/balances/daily", s.listDailyBalances)
+		r.Post("/{addr}/invoices", s.createInvoice)
+		r.Get("/{addr}/webhooks", s.listWebhooks)
+		r.Post("/{addr}/webhooks", s.createWebhook)
+		r.Delete("/{addr}/webhooks/{id}", s.deleteWebhook)
+		r.Get("/{addr}/webhooks/{id}/deliveries", s.listDeliveries)
+	})
+
+	m.Route("/invoices", func(r chi.Router) {
+		r.Get("/{id}", s.findInvoice)
 	})
 
 	m.Route("/snapshots", func(r chi.Router) {
 		r.Get("/", s.listSnapshots)
 		r.Get("/{addr}", s.listSnapshots)
+		r.Get("/{addr}/export", s.exportSnapshots)
+	})
+
+	m.Route("/notifications", func(r chi.Router) {
+		r.Get("/", s.getNotificationSetting)
+		r.Put("/", s.updateNotificationSetting)
 	})
 
 	m.Route("/addresses", func(r chi.Router) {
@@ -49,6 +84,20 @@ func (s *Server) Handler() http.Handler {
 		r.Delete("/{addr}", s.deleteAddress)
 	})
 
+	m.Route("/admin", func(r chi.Router) {
+		r.Use(s.requireAdmin)
+		r.Get("/vaults", s.adminListVaults)
+		r.Get("/vaults/{addr}", s.adminFindVault)
+		r.Post("/vaults/{addr}/renewals", s.adminGrantRenew)
+		r.Post("/vaults/{addr}/resync", s.adminResyncVault)
+		r.Get("/jobs", s.adminListJobs)
+		r.Delete("/jobs/{addr}", s.adminDeleteJob)
+		r.Get("/properties/{key}", s.adminReadProperty)
+		r.Put("/properties/{key}", s.adminSaveProperty)
+		r.Get("/backups", s.adminListBackups)
+		r.Post("/backups", s.adminBackup)
+	})
+
 	return m
 }
 
@@ -66,8 +115,11 @@ func renderErr(w http.ResponseWriter, err error) {
 type VaultView struct {
 	*Vault
 
-	Name      string    `json:"name"`
-	ExpiredAt time.Time `json:"expired_at"`
+	Name      string          `json:"name"`
+	ExpiredAt time.Time       `json:"expired_at"`
+	ValueUSD  decimal.Decimal `json:"value_usd"`
+	Currency  string          `json:"currency"`
+	Value     decimal.Decimal `json:"value"`
 }
 
 type VaultParam struct {
@@ -113,11 +165,145 @@ func extractVault(r *http.Request) (*VaultParam, error) {
 }
 
 func (s *Server) getSystemInfo(w http.ResponseWriter, r *http.Request) {
+	// pay_asset_id 和 pay_amount 兼容旧版本客户端
+	plan := s.cfg.Plans[0]
 	renderJSON(w, map[string]any{
 		"client_id":    s.client.ClientID,
-		"pay_asset_id": s.cfg.PayAssetID,
-		"pay_amount":   s.cfg.PayAmount,
+		"pay_asset_id": plan.AssetID,
+		"pay_amount":   plan.Amount.Div(decimal.NewFromInt(plan.Months)),
+		"plans":        s.cfg.Plans,
+		"currency":     s.cfg.Currency,
+	})
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	token := strings.TrimSpace(string(b))
+	if isKeystore(token) {
+		renderErr(w, twirp.InvalidArgument.Error(errKeystoreLogin.Error()))
+		return
+	}
+
+	if !isAccessToken(token) {
+		renderErr(w, twirp.InvalidArgumentError("token", "invalid"))
+		return
+	}
+
+	client, err := clientFromToken(token)
+	if err != nil {
+		renderErr(w, twirp.InvalidArgumentError("token", "invalid"))
+		return
+	}
+
+	u, err := client.UserMe(ctx)
+	if err != nil {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	user := &User{
+		MixinID: u.UserID,
+		Token:   token,
+	}
+
+	if err := s.saveUserCredential(user); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	v, err := s.issueSession(txn, &Session{
+		ID:        uuid.New(),
+		UserID:    user.MixinID,
+		CreatedAt: time.Now(),
 	})
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	if err := txn.Commit(); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) refresh(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	v, err := s.refreshSession(txn, body.RefreshToken)
+	if err != nil {
+		if errors.Is(err, errInvalidSession) {
+			renderErr(w, twirp.Unauthenticated.Error("invalid refresh token"))
+			return
+		}
+
+		renderErr(w, err)
+		return
+	}
+
+	if err := txn.Commit(); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	token := extractBearerToken(r)
+	if _, ok := UserFrom(r.Context()); !ok || !isSessionToken(token) {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return revokeSession(txn, token)
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, map[string]any{})
+}
+
+// revokeCredential 删除后台同步保存的 access token，不影响已经签发的 session
+func (s *Server) revokeCredential(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFrom(r.Context())
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return deleteCredential(txn, uuid.MustParse(user.MixinID))
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, map[string]any{})
 }
 
 func (s *Server) listVaults(w http.ResponseWriter, r *http.Request) {
@@ -133,6 +319,12 @@ func (s *Server) listVaults(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fiat, err := s.displayCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
 	txn := s.db.NewTransaction(false)
 	defer txn.Discard()
 
@@ -162,7 +354,7 @@ func (s *Server) listVaults(w http.ResponseWriter, r *http.Request) {
 			ExpiredAt: expiredAt,
 		}
 
-		s.bindVaultAssets(ctx, &view)
+		s.bindVaultAssets(ctx, &view, fiat)
 		views = append(views, view)
 	}
 
@@ -216,6 +408,12 @@ func (s *Server) findVault(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fiat, err := s.displayCurrency(p.query.Get("currency"))
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
@@ -237,7 +435,14 @@ func (s *Server) findVault(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if dur := time.Until(expiredAt); dur > 0 {
+	jobExpiredAt, err := findJobExpiredAt(txn, vault.Members, vault.Threshold)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	// 同步任务还有足够长的有效期时不需要重复写入
+	if dur := time.Until(expiredAt); dur > 0 && time.Until(jobExpiredAt) < time.Minute {
 		job := &Job{
 			CreatedAt: time.Now(),
 			User:      p.user,
@@ -261,162 +466,750 @@ func (s *Server) findVault(w http.ResponseWriter, r *http.Request) {
 		Name:      name,
 		ExpiredAt: expiredAt,
 	}
-	s.bindVaultAssets(r.Context(), &view)
+	s.bindVaultAssets(r.Context(), &view, fiat)
 	renderJSON(w, view)
 }
 
-func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request) {
-	p, err := extractVault(r)
-	if err != nil {
-		renderErr(w, err)
-		return
+func parseReceiver(s string) (*mixin.MixAddress, error) {
+	if govalidator.IsUUID(s) {
+		return mixin.NewMixAddress([]string{s}, 1)
 	}
 
-	since := cast.ToTime(p.query.Get("offset"))
-	limit := cast.ToInt(p.query.Get("limit"))
-	assetID := p.query.Get("asset")
-	if limit <= 0 || limit > 100 {
-		limit = 20
+	return mixin.MixAddressFromString(s)
+}
+
+func findVaultAsset(vault *Vault, assetID string) *Asset {
+	for _, asset := range vault.Assets {
+		if asset.ID == assetID {
+			return asset
+		}
 	}
 
-	txn := s.db.NewTransaction(false)
-	defer txn.Discard()
+	return nil
+}
 
-	snapshots, err := listSnapshots(txn, p.members, p.threshold, assetID, since, limit)
+func (s *Server) createRequest(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
 	if err != nil {
-		slog.Error("listSnapshots", "error", err)
 		renderErr(w, err)
 		return
 	}
 
-	renderJSON(w, snapshots)
-}
+	var body struct {
+		RequestID string          `json:"request_id"`
+		AssetID   string          `json:"asset_id"`
+		Amount    decimal.Decimal `json:"amount"`
+		Receiver  string          `json:"receiver"`
+		Memo      string          `json:"memo"`
+	}
 
-func (s *Server) listAddresses(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user, ok := UserFrom(ctx)
-	if !ok {
-		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
 		return
 	}
 
-	outputs, err := ListAddress(s.db, uuid.MustParse(user.MixinID))
-	if err != nil {
-		renderErr(w, err)
+	if body.RequestID == "" {
+		body.RequestID = uuid.NewString()
+	} else if !govalidator.IsUUID(body.RequestID) {
+		renderErr(w, twirp.InvalidArgumentError("request_id", "invalid"))
 		return
 	}
 
-	renderJSON(w, outputs)
-}
+	if !govalidator.IsUUID(body.AssetID) {
+		renderErr(w, twirp.InvalidArgumentError("asset_id", "invalid"))
+		return
+	}
 
-func (s *Server) deleteAddress(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user, ok := UserFrom(ctx)
-	if !ok {
-		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+	if !body.Amount.IsPositive() || !body.Amount.Equal(body.Amount.Truncate(8)) {
+		renderErr(w, twirp.InvalidArgumentError("amount", "invalid"))
 		return
 	}
 
-	addr, err := mixin.MixAddressFromString(chi.URLParam(r, "addr"))
-	if err != nil {
-		renderErr(w, twirp.InvalidArgument.Error("invalid address"))
+	if len(body.Memo) > maxMemoLength {
+		renderErr(w, twirp.InvalidArgumentError("memo", "too long"))
 		return
 	}
 
-	v := Address{
-		UserID:    uuid.MustParse(user.MixinID),
-		Members:   addr.Members(),
-		Threshold: uint8(addr.Threshold),
+	receiver, err := parseReceiver(body.Receiver)
+	if err != nil {
+		renderErr(w, twirp.InvalidArgumentError("receiver", "invalid"))
+		return
 	}
 
-	if err := s.db.Update(func(txn *badger.Txn) error {
-		return saveAddress(txn, v)
-	}); err != nil {
+	vault, err := FindVault(s.db, p.members, p.threshold)
+	if err != nil {
 		renderErr(w, err)
 		return
 	}
 
-	renderJSON(w, v)
-}
-
-func (s *Server) saveAddress(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user, ok := UserFrom(ctx)
-	if !ok {
-		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+	if asset := findVaultAsset(vault, body.AssetID); asset == nil || body.Amount.GreaterThan(asset.Unspent) {
+		renderErr(w, twirp.FailedPrecondition.Error("insufficient balance"))
 		return
 	}
 
-	var body struct {
-		Address   string   `json:"address"`
-		Members   []string `json:"members"`
-		Threshold uint8    `json:"threshold"`
-		Label     string   `json:"label"`
+	token, err := s.userToken(p.user)
+	if err != nil {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+	// access token 需要授权读取 utxo 的 scope
+	if !accessTokenHasScope(token, multisigRequestScope) {
+		renderErr(w, twirp.PermissionDenied.Error("access token missing scope "+multisigRequestScope))
 		return
 	}
 
-	if body.Address != "" {
-		addr, err := mixin.MixAddressFromString(body.Address)
-		if err != nil {
-			renderErr(w, twirp.InvalidArgumentError("address", "invalid"))
-			return
-		}
-		body.Members = addr.Members()
-		body.Threshold = addr.Threshold
-	} else if _, err := mixin.NewMixAddress(body.Members, body.Threshold); err != nil {
-		renderErr(w, twirp.InvalidArgumentError("members", "invalid"))
+	client, err := clientFromToken(token)
+	if err != nil {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
 		return
 	}
 
-	v := Address{
-		UserID:    uuid.MustParse(user.MixinID),
-		Members:   body.Members,
-		Threshold: body.Threshold,
-		Label:     strings.TrimSpace(body.Label),
-		UpdatedAt: time.Now(),
-	}
+	req, err := createMultisigRequest(r.Context(), client, &TransferInput{
+		RequestID: body.RequestID,
+		Members:   p.members,
+		Threshold: p.threshold,
+		AssetID:   body.AssetID,
+		Amount:    body.Amount,
+		Receiver:  receiver,
+		Memo:      body.Memo,
+	})
 
-	if v.Label == "" {
-		renderErr(w, twirp.InvalidArgument.Error("label is required"))
+	if err != nil {
+		slog.Error("createMultisigRequest", "error", err)
+		renderErr(w, createRequestErr(err))
 		return
 	}
 
+	// 没有人签名之前请求不会锁定 utxo，同步时发现不了，创建时就保存；
+	// 重复提交同一个 request_id 时保留同步得到的记录
 	if err := s.db.Update(func(txn *badger.Txn) error {
-		return saveAddress(txn, v)
+		mr := requestToMultisigRequest(req, p.members, p.threshold, MultisigRequestStateInitial)
+		if _, err := findMultisigRequest(txn, mr.ID); err == nil || !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		return applyMultisigRequest(txn, mr, false)
 	}); err != nil {
+		slog.Error("applyMultisigRequest", "error", err)
 		renderErr(w, err)
 		return
 	}
 
-	renderJSON(w, v)
+	s.events.publish(p.members, p.threshold)
+	renderJSON(w, req)
 }
 
-func (s *Server) getSafeAsset(ctx context.Context, id string) (*mixin.SafeAsset, error) {
-	v, ok := s.assets.Get(id)
-	if ok {
-		return v, nil
+// createRequestErr 不把 Mixin 接口的错误直接返回给客户端
+func createRequestErr(err error) error {
+	switch {
+	case errors.Is(err, errInsufficientBalance):
+		return twirp.FailedPrecondition.Error("insufficient balance")
+	case errors.Is(err, errTooManyUtxos):
+		return twirp.FailedPrecondition.Error("too many utxos, merge them before transferring")
+	default:
+		return twirp.Internal.Error("create request failed")
 	}
+}
 
-	v, err := s.client.SafeReadAsset(ctx, id)
+func (s *Server) listRequests(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
 	if err != nil {
-		return nil, err
+		renderErr(w, err)
+		return
 	}
 
-	s.assets.Set(id, v, cache.WithTTL(10*time.Minute))
-	return v, nil
+	since := cast.ToTime(p.query.Get("offset"))
+	limit := cast.ToInt(p.query.Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	requests, err := listMultisigRequests(txn, p.members, p.threshold, since, limit)
+	if err != nil {
+		slog.Error("listMultisigRequests", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, requests)
 }
 
-func (s *Server) bindVaultAssets(ctx context.Context, view *VaultView) {
-	for _, asset := range view.Assets {
-		v, err := s.getSafeAsset(ctx, asset.ID)
-		if err != nil {
-			continue
-		}
+func (s *Server) findRequest(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
 
-		asset.Asset = v
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		renderErr(w, twirp.InvalidArgumentError("id", "invalid"))
+		return
 	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	req, err := findMultisigRequest(txn, id)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			renderErr(w, twirp.NotFoundError("request not found"))
+			return
+		}
+
+		renderErr(w, err)
+		return
+	}
+
+	if hashMembers(req.Members, req.Threshold) != hashMembers(p.members, p.threshold) {
+		renderErr(w, twirp.NotFoundError("request not found"))
+		return
+	}
+
+	renderJSON(w, req)
+}
+
+func (s *Server) listRenewals(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	since := cast.ToTime(p.query.Get("offset"))
+	limit := cast.ToInt(p.query.Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	// offset_id 为上一页最后一条记录的 id，避免跳过时间相同的记录
+	var after uuid.UUID
+	if v := p.query.Get("offset_id"); v != "" {
+		if after, err = uuid.Parse(v); err != nil {
+			renderErr(w, twirp.InvalidArgumentError("offset_id", "invalid"))
+			return
+		}
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	renews, err := listRenews(txn, p.members, p.threshold, since, after, limit)
+	if err != nil {
+		slog.Error("listRenews", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, renews)
+}
+
+func (s *Server) createInvoice(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	var body struct {
+		Plan string `json:"plan"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	plan := s.cfg.Plans[0]
+	if body.Plan != "" {
+		if plan = findPlan(s.cfg.Plans, body.Plan); plan == nil {
+			renderErr(w, twirp.InvalidArgumentError("plan", "not found"))
+			return
+		}
+	}
+
+	addr := mixin.RequireNewMixAddress(p.members, p.threshold)
+	v := newInvoice(s.client.ClientID, addr, plan)
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return saveInvoice(txn, v)
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) findInvoice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := UserFrom(ctx)
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		renderErr(w, twirp.InvalidArgumentError("id", "invalid"))
+		return
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	v, err := findInvoice(txn, id)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			renderErr(w, twirp.NotFoundError("invoice not found"))
+			return
+		}
+
+		renderErr(w, err)
+		return
+	}
+
+	if !govalidator.IsIn(user.MixinID, v.Members...) {
+		renderErr(w, twirp.NotFoundError("invoice not found"))
+		return
+	}
+
+	v.State = invoiceState(v, time.Now())
+	renderJSON(w, v)
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	if err := checkWebhookURL(r.Context(), body.URL); err != nil {
+		if errors.Is(err, errWebhookAddress) {
+			renderErr(w, twirp.InvalidArgumentError("url", "must resolve to a public address"))
+			return
+		}
+
+		renderErr(w, twirp.InvalidArgumentError("url", "invalid"))
+		return
+	}
+
+	hook := &Webhook{
+		ID:        uuid.New(),
+		User:      p.user.MixinID,
+		Members:   p.members,
+		Threshold: p.threshold,
+		URL:       body.URL,
+		Secret:    newWebhookSecret(),
+		CreatedAt: time.Now(),
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return saveWebhook(txn, hook)
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	// secret 只在创建时返回
+	renderJSON(w, hook)
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	webhooks, err := listWebhooks(txn, p.members, p.threshold)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	for _, hook := range webhooks {
+		hook.Secret = ""
+	}
+
+	renderJSON(w, webhooks)
+}
+
+func (s *Server) findVaultWebhook(txn *badger.Txn, r *http.Request, p *VaultParam) (*Webhook, error) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, twirp.InvalidArgumentError("id", "invalid")
+	}
+
+	hook, err := findWebhook(txn, id)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, twirp.NotFoundError("webhook not found")
+		}
+
+		return nil, err
+	}
+
+	if hashMembers(hook.Members, hook.Threshold) != hashMembers(p.members, p.threshold) {
+		return nil, twirp.NotFoundError("webhook not found")
+	}
+
+	return hook, nil
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer txn.Discard()
+
+	hook, err := s.findVaultWebhook(txn, r, p)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	if err := deleteWebhook(txn, hook); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	if err := txn.Commit(); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	hook.Secret = ""
+	renderJSON(w, hook)
+}
+
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	since := cast.ToTime(p.query.Get("offset"))
+	limit := cast.ToInt(p.query.Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	hook, err := s.findVaultWebhook(txn, r, p)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	deliveries, err := listDeliveries(txn, hook.ID, since, limit)
+	if err != nil {
+		slog.Error("listDeliveries", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, deliveries)
+}
+
+func (s *Server) findSchedule(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	schedule, err := FindSchedule(s.db, p.members, p.threshold)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, schedule)
+}
+
+func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	since := cast.ToTime(p.query.Get("offset"))
+	limit := cast.ToInt(p.query.Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	f, err := parseSnapshotFilter(p.query)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	fiat, err := s.displayCurrency(p.query.Get("currency"))
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	// 带上 cursor 参数（第一页为空）时使用游标分页
+	if p.query.Has("cursor") {
+		s.listSnapshotsByCursor(w, txn, p, f, fiat, limit)
+		return
+	}
+
+	snapshots, err := listSnapshots(txn, p.members, p.threshold, f, since, limit)
+	if err != nil {
+		slog.Error("listSnapshots", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	bindSnapshotValues(snapshots, fiat)
+	renderJSON(w, snapshots)
+}
+
+func (s *Server) listSnapshotsByCursor(w http.ResponseWriter, txn *badger.Txn, p *VaultParam, f *SnapshotFilter, fiat *fiatCurrency, limit int) {
+	var cursor *SnapshotCursor
+	if v := p.query.Get("cursor"); v != "" {
+		c, err := ParseSnapshotCursor(v)
+		if err != nil {
+			renderErr(w, twirp.InvalidArgumentError("cursor", "invalid"))
+			return
+		}
+
+		cursor = c
+	}
+
+	direction := p.query.Get("direction")
+	if direction == "" {
+		direction = CursorDirectionNext
+	} else if direction != CursorDirectionNext && direction != CursorDirectionPrev {
+		renderErr(w, twirp.InvalidArgumentError("direction", "must be next or prev"))
+		return
+	}
+
+	page, err := listSnapshotsByCursor(txn, p.members, p.threshold, f, cursor, direction, limit)
+	if err != nil {
+		slog.Error("listSnapshotsByCursor", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	if cast.ToBool(p.query.Get("count")) {
+		total, capped, err := countSnapshots(txn, p.members, p.threshold, f)
+		if err != nil {
+			slog.Error("countSnapshots", "error", err)
+			renderErr(w, err)
+			return
+		}
+
+		page.Total = &total
+		page.TotalCapped = capped
+	}
+
+	bindSnapshotValues(page.Data, fiat)
+	renderJSON(w, page)
+}
+
+func (s *Server) listAddresses(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := UserFrom(ctx)
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	outputs, err := ListAddress(s.db, uuid.MustParse(user.MixinID))
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, outputs)
+}
+
+func (s *Server) deleteAddress(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := UserFrom(ctx)
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	addr, err := mixin.MixAddressFromString(chi.URLParam(r, "addr"))
+	if err != nil {
+		renderErr(w, twirp.InvalidArgument.Error("invalid address"))
+		return
+	}
+
+	v := Address{
+		UserID:    uuid.MustParse(user.MixinID),
+		Members:   addr.Members(),
+		Threshold: uint8(addr.Threshold),
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return saveAddress(txn, v)
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) saveAddress(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := UserFrom(ctx)
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	var body struct {
+		Address   string   `json:"address"`
+		Members   []string `json:"members"`
+		Threshold uint8    `json:"threshold"`
+		Label     string   `json:"label"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	if body.Address != "" {
+		addr, err := mixin.MixAddressFromString(body.Address)
+		if err != nil {
+			renderErr(w, twirp.InvalidArgumentError("address", "invalid"))
+			return
+		}
+		body.Members = addr.Members()
+		body.Threshold = addr.Threshold
+	} else if _, err := mixin.NewMixAddress(body.Members, body.Threshold); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("members", "invalid"))
+		return
+	}
+
+	v := Address{
+		UserID:    uuid.MustParse(user.MixinID),
+		Members:   body.Members,
+		Threshold: body.Threshold,
+		Label:     strings.TrimSpace(body.Label),
+		UpdatedAt: time.Now(),
+	}
+
+	if v.Label == "" {
+		renderErr(w, twirp.InvalidArgument.Error("label is required"))
+		return
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return saveAddress(txn, v)
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) getNotificationSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := UserFrom(ctx)
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	v, err := getNotificationSetting(txn, uuid.MustParse(user.MixinID))
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) updateNotificationSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := UserFrom(ctx)
+	if !ok {
+		renderErr(w, twirp.Unauthenticated.Error("unauthenticated"))
+		return
+	}
+
+	var body struct {
+		Disabled bool `json:"disabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		renderErr(w, twirp.InvalidArgumentError("body", "invalid"))
+		return
+	}
+
+	v := &NotificationSetting{
+		User:      uuid.MustParse(user.MixinID),
+		Disabled:  body.Disabled,
+		UpdatedAt: time.Now(),
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return saveNotificationSetting(txn, v)
+	}); err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) getSafeAsset(ctx context.Context, id string) (*mixin.SafeAsset, error) {
+	v, ok := s.assets.Get(id)
+	if ok {
+		assetCacheTotal.Inc("hit")
+		return v, nil
+	}
+
+	assetCacheTotal.Inc("miss")
+
+	v, err := s.client.SafeReadAsset(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.assets.Set(id, v, cache.WithTTL(10*time.Minute))
+	return v, nil
 }
@@ -1,13 +1,16 @@
 package cowallet
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/twitchtv/twirp"
 	"github.com/yiplee/go-cache"
 	"golang.org/x/sync/singleflight"
 )
@@ -17,7 +20,85 @@ func extractBearerToken(r *http.Request) string {
 	return strings.TrimPrefix(token, "Bearer ")
 }
 
+// isAccessToken 判断是否为 Mixin OAuth access token (JWT)
+func isAccessToken(token string) bool {
+	return !isSessionToken(token) && strings.Count(token, ".") == 2 && !strings.HasPrefix(token, "{")
+}
+
+// isKeystore 判断是否为 json 格式的 keystore
+func isKeystore(token string) bool {
+	return strings.HasPrefix(strings.TrimSpace(token), "{")
+}
+
+type accessTokenClaims struct {
+	ExpiredAt int64  `json:"exp"`
+	Scope     string `json:"scp"`
+}
+
+// parseAccessToken 读取 JWT 的 claims，签名由 Mixin 在调用 /me 时校验
+func parseAccessToken(token string) (*accessTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid access token")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("decode access token failed: %w", err)
+	}
+
+	var claims accessTokenClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("decode access token failed: %w", err)
+	}
+
+	return &claims, nil
+}
+
+// accessTokenExpiredAt 读取 JWT 的 exp
+func accessTokenExpiredAt(token string) (time.Time, error) {
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if claims.ExpiredAt == 0 {
+		return time.Time{}, fmt.Errorf("access token without exp")
+	}
+
+	return time.Unix(claims.ExpiredAt, 0), nil
+}
+
+// accessTokenHasScope 判断 access token 是否授权了 scope，多个 scope 以空格分隔
+func accessTokenHasScope(token, scope string) bool {
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		return false
+	}
+
+	for _, v := range strings.Fields(claims.Scope) {
+		if v == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
 func clientFromToken(token string) (*mixin.Client, error) {
+	if isAccessToken(token) {
+		expiredAt, err := accessTokenExpiredAt(token)
+		if err != nil {
+			return nil, err
+		}
+
+		if time.Now().After(expiredAt) {
+			return nil, fmt.Errorf("access token expired")
+		}
+
+		return mixin.NewFromAccessToken(token), nil
+	}
+
 	r := strings.NewReader(token)
 
 	var auth mixin.OauthKeystore
@@ -34,7 +115,7 @@ func clientFromToken(token string) (*mixin.Client, error) {
 	return nil, fmt.Errorf("decode token failed")
 }
 
-func handleAuth() func(next http.Handler) http.Handler {
+func (s *Server) handleAuth() func(next http.Handler) http.Handler {
 	var (
 		users = cache.New[string, *User]()
 		sf    singleflight.Group
@@ -45,6 +126,25 @@ func handleAuth() func(next http.Handler) http.Handler {
 			ctx := r.Context()
 			token := extractBearerToken(r)
 
+			if isSessionToken(token) {
+				txn := s.db.NewTransaction(false)
+				user, err := s.verifyAccessToken(txn, token)
+				txn.Discard()
+
+				if err != nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(WithUser(ctx, user)))
+				return
+			}
+
+			if isKeystore(token) {
+				renderErr(w, twirp.Unauthenticated.Error(errKeystoreLogin.Error()))
+				return
+			}
+
 			client, err := clientFromToken(token)
 			if err != nil {
 				slog.Error("clientFromToken", "err", err)
@@ -74,7 +174,15 @@ func handleAuth() func(next http.Handler) http.Handler {
 					Token:   token,
 				}
 
-				users.Set(token, user)
+				// 后台同步使用加密保存的 access token
+				if err := s.saveUserCredential(user); err != nil {
+					return nil, err
+				}
+
+				expiredAt, _ := accessTokenExpiredAt(token)
+				ttl := min(10*time.Minute, time.Until(expiredAt))
+
+				users.Set(token, user, cache.WithTTL(ttl))
 				return user, nil
 			})
 
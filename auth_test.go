@@ -0,0 +1,34 @@
+package cowallet
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	build := func(exp time.Time) string {
+		claims := fmt.Sprintf(`{"aid":"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d","exp":%d,"scp":"PROFILE:READ ASSETS:READ"}`, exp.Unix())
+		return "eyJhbGciOiJFZERTQSIsInR5cCI6IkpXVCJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+	}
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := build(exp)
+
+	if !isAccessToken(token) || isAccessToken(`{"client_id":"foo"}`) || isAccessToken("cw.a.b") {
+		t.Fatal("isAccessToken mismatch")
+	}
+
+	if got, err := accessTokenExpiredAt(token); err != nil || !got.Equal(exp) {
+		t.Fatalf("accessTokenExpiredAt: %s %v", got, err)
+	}
+
+	if !accessTokenHasScope(token, "ASSETS:READ") || accessTokenHasScope(token, multisigRequestScope) {
+		t.Fatal("accessTokenHasScope mismatch")
+	}
+
+	if _, err := clientFromToken(build(time.Now().Add(-time.Minute))); err == nil {
+		t.Fatal("expired access token accepted")
+	}
+}
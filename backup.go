@@ -0,0 +1,287 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	lastBackupProperty = "last_backup"
+	backupTimeLayout   = "20060102T150405.000Z"
+
+	DefaultBackupInterval = 6 * time.Hour
+	DefaultBackupKeep     = 7
+
+	// 每个全量备份之后最多跟多少个增量备份，默认间隔下大约一周做一次全量备份
+	backupChainLength = 28
+)
+
+// BackupInfo 备份文件的信息，文件名里记录了备份的版本范围，
+// Since 为 0 的是全量备份，其他的是从上一个备份的 Version+1 开始的增量备份
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Since     uint64    `json:"since"`
+	Version   uint64    `json:"version"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (b *BackupInfo) Full() bool {
+	return b.Since == 0
+}
+
+func (b *BackupInfo) fileName() string {
+	return fmt.Sprintf("cowallet-%s-%d-%d.bak", b.CreatedAt.UTC().Format(backupTimeLayout), b.Since, b.Version)
+}
+
+func parseBackupName(name string) (*BackupInfo, bool) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "cowallet-"), ".bak"), "-")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	createdAt, err := time.Parse(backupTimeLayout, parts[0])
+	if err != nil {
+		return nil, false
+	}
+
+	since, err1 := strconv.ParseUint(parts[1], 10, 64)
+	version, err2 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, false
+	}
+
+	b := &BackupInfo{
+		Name:      name,
+		Since:     since,
+		Version:   version,
+		CreatedAt: createdAt,
+	}
+
+	return b, b.fileName() == name
+}
+
+// ListBackups 按时间顺序列出目录里的备份
+func ListBackups(dir string) ([]*BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var backups []*BackupInfo
+	for _, e := range entries {
+		b, ok := parseBackupName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+
+		if info, err := e.Info(); err == nil {
+			b.Size = info.Size()
+		}
+
+		backups = append(backups, b)
+	}
+
+	slices.SortFunc(backups, func(a, b *BackupInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return backups, nil
+}
+
+// BackupChain 返回恢复最新状态需要的备份：最后一个全量备份和之后连续的增量备份
+func BackupChain(dir string) ([]*BackupInfo, error) {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	start := -1
+	for i, b := range backups {
+		if b.Full() {
+			start = i
+		}
+	}
+
+	if start < 0 {
+		return nil, fmt.Errorf("no full backup in %s", dir)
+	}
+
+	chain := []*BackupInfo{backups[start]}
+	for _, b := range backups[start+1:] {
+		if b.Since != chain[len(chain)-1].Version+1 {
+			break
+		}
+
+		chain = append(chain, b)
+	}
+
+	return chain, nil
+}
+
+var backupMu sync.Mutex
+
+// Backup 在线备份数据库到 dir，incremental 时从 last_backup 记录的版本开始，
+// 记录的备份不是目录里备份链的最后一个（换了目录或者数据库是恢复出来的）时做全量备份
+func Backup(db *badger.DB, dir string, incremental bool) (*BackupInfo, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	b := &BackupInfo{CreatedAt: time.Now()}
+	if incremental {
+		var last BackupInfo
+		if err := ReadProperty(db, lastBackupProperty, &last); err != nil {
+			return nil, err
+		}
+
+		if chain, err := BackupChain(dir); err == nil && last.Name != "" && chain[len(chain)-1].Name == last.Name {
+			b.Since = last.Version + 1
+		}
+	}
+
+	f, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	version, err := db.Backup(f, b.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有新的数据时，下一次增量备份仍然从同一个版本开始
+	if b.Since > 0 && version < b.Since {
+		version = b.Since - 1
+	}
+
+	b.Version = version
+
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b.Name = b.fileName()
+	b.Size = info.Size()
+	if err := os.Rename(f.Name(), filepath.Join(dir, b.Name)); err != nil {
+		return nil, err
+	}
+
+	if err := SaveProperty(db, lastBackupProperty, b); err != nil {
+		return nil, err
+	}
+
+	slog.Info("backup", "name", b.Name, "since", b.Since, "version", b.Version, "size", b.Size)
+	return b, nil
+}
+
+// RestoreBackups 按顺序把备份加载到新的数据库，增量备份需要从全量备份开始依次加载
+func RestoreBackups(db *badger.DB, files ...string) error {
+	for _, name := range files {
+		if err := restoreBackup(db, name); err != nil {
+			return fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func restoreBackup(db *badger.DB, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return db.Load(f, 256)
+}
+
+// PruneBackups 只保留最近 keep 个全量备份以及之后的增量备份
+func PruneBackups(dir string, keep int) error {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	var fulls []int
+	for i, b := range backups {
+		if b.Full() {
+			fulls = append(fulls, i)
+		}
+	}
+
+	if len(fulls) <= keep {
+		return nil
+	}
+
+	for _, b := range backups[:fulls[len(fulls)-keep]] {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return err
+		}
+
+		slog.Info("prune backup", "name", b.Name)
+	}
+
+	return nil
+}
+
+// LoopBackups 定期备份到 BackupDir，没有配置目录时不备份
+func (s *Server) LoopBackups(ctx context.Context) error {
+	if s.cfg.BackupDir == "" {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.cfg.BackupInterval):
+		}
+
+		_ = s.loopBackups()
+	}
+}
+
+func (s *Server) loopBackups() error {
+	chain, _ := BackupChain(s.cfg.BackupDir)
+	incremental := len(chain) > 0 && len(chain) <= backupChainLength
+
+	if _, err := Backup(s.db, s.cfg.BackupDir, incremental); err != nil {
+		slog.Error("Backup", "error", err)
+		return err
+	}
+
+	if err := PruneBackups(s.cfg.BackupDir, s.cfg.BackupKeep); err != nil {
+		slog.Error("PruneBackups", "error", err)
+		return err
+	}
+
+	return nil
+}
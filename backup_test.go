@@ -0,0 +1,80 @@
+package cowallet
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	db := newTestDB(t)
+
+	dir := t.TempDir()
+
+	if err := SaveProperty(db, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := Backup(db, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !full.Full() {
+		t.Fatal("first backup should be full")
+	}
+
+	if err := SaveProperty(db, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	incr, err := Backup(db, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if incr.Since != full.Version+1 {
+		t.Fatalf("incremental backup should start from %d, got %d", full.Version+1, incr.Since)
+	}
+
+	chain, err := BackupChain(dir)
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("want 2 backups in chain, got %d, %v", len(chain), err)
+	}
+
+	restored := newTestDB(t)
+
+	if err := RestoreBackups(restored, filepath.Join(dir, chain[0].Name), filepath.Join(dir, chain[1].Name)); err != nil {
+		t.Fatal(err)
+	}
+
+	var a, b int
+	if err := ReadProperty(restored, "a", &a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReadProperty(restored, "b", &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if a != 1 || b != 2 {
+		t.Fatalf("unexpected restored values %d %d", a, b)
+	}
+
+	// 恢复出来的数据库记录的不是目录里最后一个备份，增量备份会变成全量备份
+	if b, err := Backup(restored, dir, true); err != nil || !b.Full() {
+		t.Fatalf("want full backup from restored db, got %+v, %v", b, err)
+	}
+
+	// 新的全量备份之后，只保留一个全量备份时删除之前的整条链
+	if _, err := Backup(db, dir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneBackups(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if backups, err := ListBackups(dir); err != nil || len(backups) != 1 || !backups[0].Full() {
+		t.Fatalf("want only the latest full backup, got %d, %v", len(backups), err)
+	}
+}
@@ -0,0 +1,311 @@
+package cowallet
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+	"github.com/twitchtv/twirp"
+)
+
+const (
+	checkpointDateLayout = time.DateOnly
+
+	// 每日余额接口一次最多返回的天数
+	maxBalanceDays = 366
+)
+
+type DailyBalance struct {
+	Date   string               `json:"date"`
+	Assets []*BalanceCheckpoint `json:"assets"`
+}
+
+func checkpointDate(t time.Time) string {
+	return t.UTC().Format(checkpointDateLayout)
+}
+
+// saveVaultCheckpoints 用同步后的余额覆盖当天的记录，当天最后一次同步的余额就是日终余额，
+// 之前有余额但已经转空的资产记为 0
+func saveVaultCheckpoints(txn *badger.Txn, vault *Vault) error {
+	now := time.Now()
+	date := checkpointDate(now)
+
+	prev, err := findBalances(txn, vault.Members, vault.Threshold, date)
+	if err != nil {
+		return err
+	}
+
+	balances := map[string]decimal.Decimal{}
+	for _, c := range prev.Assets {
+		balances[c.AssetID] = decimal.Zero
+	}
+
+	for _, asset := range vault.Assets {
+		balances[asset.ID] = asset.Balance
+	}
+
+	checkpoints := make([]*BalanceCheckpoint, 0, len(balances))
+	for assetID, balance := range balances {
+		checkpoints = append(checkpoints, &BalanceCheckpoint{
+			Date:      date,
+			AssetID:   assetID,
+			Balance:   balance,
+			UpdatedAt: now,
+		})
+	}
+
+	return saveCheckpoints(txn, vault.Members, vault.Threshold, date, checkpoints)
+}
+
+// backfillBalances 根据已经保存的 snapshot 为已有的 vault 补上历史余额，
+// 只补最早一条记录之前的日期，重复执行不会覆盖同步写入的记录，返回补上的天数；
+// 每个 vault 一次写完，中途退出后重新执行会跳过已经补完的 vault
+func backfillBalances(ctx context.Context, db *badger.DB, dryRun bool) (int, error) {
+	txn := db.NewTransaction(false)
+	vaults, err := listAllVaults(txn)
+	txn.Discard()
+
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Info("backfill balances", "vaults", len(vaults), "dry_run", dryRun)
+
+	var n int
+	for _, vault := range vaults {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		days, err := backfillVaultBalances(db, vault, dryRun)
+		if err != nil {
+			slog.Error("backfillVaultBalances", "error", err)
+			return 0, err
+		}
+
+		n += days
+	}
+
+	return n, nil
+}
+
+func backfillVaultBalances(db *badger.DB, vault *Vault, dryRun bool) (int, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	// 已经有同步写入的记录，以同步的结果为准
+	var earliest string
+	if err := walkCheckpoints(txn, vault.Members, vault.Threshold, "", checkpointDate(time.Now()), func(c *BalanceCheckpoint) error {
+		if earliest == "" {
+			earliest = c.Date
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	var (
+		balances = map[string]decimal.Decimal{}
+		days     = map[string][]*BalanceCheckpoint{}
+		date     string
+	)
+
+	flush := func() {
+		if date == "" || (earliest != "" && date >= earliest) {
+			return
+		}
+
+		// 转空的资产也要记录，否则会沿用之前的余额
+		for assetID, balance := range balances {
+			days[date] = append(days[date], &BalanceCheckpoint{
+				Date:      date,
+				AssetID:   assetID,
+				Balance:   balance,
+				UpdatedAt: time.Now(),
+			})
+		}
+	}
+
+	prefix, err := snapshotIndexPrefix(vault.Members, vault.Threshold, "")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := scanSnapshots(txn, prefix, prefix, false, &SnapshotFilter{}, func(_ []byte, s *Snapshot) (bool, error) {
+		if d := checkpointDate(s.CreatedAt); d != date {
+			flush()
+			date = d
+		}
+
+		balances[s.AssetID] = balances[s.AssetID].Add(s.Amount)
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	flush()
+	txn.Discard()
+
+	if dryRun {
+		return len(days), nil
+	}
+
+	dates := make([]string, 0, len(days))
+	for d := range days {
+		dates = append(dates, d)
+	}
+
+	sort.Strings(dates)
+
+	// 一个 vault 的所有日期在同一个事务里按日期顺序写入，中途退出时不会只留下一部分，
+	// 否则重新执行时会把已经写入的最早一天当成同步的记录，跳过之后没有写入的日期
+	if err := db.Update(func(txn *badger.Txn) error {
+		for _, d := range dates {
+			if err := saveCheckpoints(txn, vault.Members, vault.Threshold, d, days[d]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(days), nil
+}
+
+// findBalances 返回 date 当天结束时的余额，那天没有记录时使用之前最近的一次记录
+func findBalances(txn *badger.Txn, members []string, threshold uint8, date string) (*DailyBalance, error) {
+	last, err := lastCheckpointDate(txn, members, threshold, date)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &DailyBalance{Date: date, Assets: []*BalanceCheckpoint{}}
+	if last == "" {
+		return v, nil
+	}
+
+	if v.Assets, err = listCheckpoints(txn, members, threshold, last); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// listDailyBalances 返回 [from, to] 每一天的余额，没有记录的日期沿用前一天的余额
+func listDailyBalances(txn *badger.Txn, members []string, threshold uint8, assetID string, from, to time.Time) ([]*DailyBalance, error) {
+	start, err := findBalances(txn, members, threshold, checkpointDate(from.AddDate(0, 0, -1)))
+	if err != nil {
+		return nil, err
+	}
+
+	byDate := map[string][]*BalanceCheckpoint{}
+	if err := walkCheckpoints(txn, members, threshold, checkpointDate(from), checkpointDate(to), func(c *BalanceCheckpoint) error {
+		byDate[c.Date] = append(byDate[c.Date], c)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var (
+		series  []*DailyBalance
+		current = start.Assets
+	)
+
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := checkpointDate(day)
+		if checkpoints, ok := byDate[date]; ok {
+			current = checkpoints
+		}
+
+		v := &DailyBalance{Date: date, Assets: []*BalanceCheckpoint{}}
+		for _, c := range current {
+			if assetID == "" || c.AssetID == assetID {
+				v.Assets = append(v.Assets, c)
+			}
+		}
+
+		series = append(series, v)
+	}
+
+	return series, nil
+}
+
+func (s *Server) getBalances(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	at := time.Now()
+	if v := p.query.Get("at"); v != "" {
+		if at, err = cast.ToTimeE(v); err != nil {
+			renderErr(w, twirp.InvalidArgumentError("at", "invalid"))
+			return
+		}
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	v, err := findBalances(txn, p.members, p.threshold, checkpointDate(at))
+	if err != nil {
+		slog.Error("findBalances", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, v)
+}
+
+func (s *Server) listDailyBalances(w http.ResponseWriter, r *http.Request) {
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	assetID := p.query.Get("asset")
+	if assetID != "" {
+		if _, err := uuid.Parse(assetID); err != nil {
+			renderErr(w, twirp.InvalidArgumentError("asset", "invalid"))
+			return
+		}
+	}
+
+	to := cast.ToTime(p.query.Get("to"))
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	from := cast.ToTime(p.query.Get("from"))
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -29)
+	}
+
+	if from.After(to) || to.Sub(from) > maxBalanceDays*24*time.Hour {
+		renderErr(w, twirp.InvalidArgumentError("from", "range must be within 366 days"))
+		return
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	series, err := listDailyBalances(txn, p.members, p.threshold, assetID, from, to)
+	if err != nil {
+		slog.Error("listDailyBalances", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	renderJSON(w, series)
+}
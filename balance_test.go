@@ -0,0 +1,79 @@
+package cowallet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestDailyBalances(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		assetID   = "965e5c6e-434c-3fa9-b780-c50f43cd955c"
+		today     = time.Now().UTC().Truncate(24 * time.Hour)
+	)
+
+	// 三天前收到 10，前天转出 4，今天转出剩下的 6
+	amounts := map[int]int64{-3: 10, -2: -4}
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := saveVault(txn, &Vault{Members: members, Threshold: threshold}); err != nil {
+			return err
+		}
+
+		for day, amount := range amounts {
+			if err := saveSnapshot(txn, &Snapshot{
+				ID:        uuid.New(),
+				CreatedAt: today.AddDate(0, 0, day).Add(time.Hour),
+				AssetID:   assetID,
+				Amount:    decimal.NewFromInt(amount),
+			}, members, threshold); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backfillBalances(context.Background(), db, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveVaultCheckpoints(txn, &Vault{Members: members, Threshold: threshold})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	series, err := listDailyBalances(txn, members, threshold, assetID, today.AddDate(0, 0, -4), today)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"", "10", "6", "6", "0"}
+	if len(series) != len(want) {
+		t.Fatalf("want %d days, got %d", len(want), len(series))
+	}
+
+	for i, v := range series {
+		got := ""
+		if len(v.Assets) > 0 {
+			got = v.Assets[0].Balance.String()
+		}
+
+		if got != want[i] {
+			t.Errorf("%s: want balance %q, got %q", v.Date, want[i], got)
+		}
+	}
+}
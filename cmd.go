@@ -1,5 +1,13 @@
 package cowallet
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/pandodao/mtg/mtgpack"
+)
+
 const (
 	_                 uint8 = iota
 	CommandRenewVault       // 确认续费
@@ -7,4 +15,70 @@ const (
 	CommandDelAddress       // 删除地址
 )
 
+const maxLabelLength = 64
+
+// Command 转账 memo 里携带的指令，格式为一个字节的指令加上 mtgpack 编码的参数
+type Command struct {
+	Action  uint8
+	Address *mixin.MixAddress
+	Label   string
+}
+
+func DecodeCommand(b []byte) (*Command, error) {
+	// 兼容旧版本，memo 直接是 vault 的 mix address
+	if addr, err := mixin.MixAddressFromString(string(b)); err == nil {
+		return &Command{
+			Action:  CommandRenewVault,
+			Address: addr,
+		}, nil
+	}
+
+	if len(b) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	var (
+		cmd  = &Command{Action: b[0]}
+		dec  = mtgpack.NewDecoder(b[1:])
+		addr string
+	)
+
+	switch cmd.Action {
+	case CommandRenewVault, CommandDelAddress:
+		if err := dec.DecodeValues(&addr); err != nil {
+			return nil, fmt.Errorf("decode args failed: %w", err)
+		}
+	case CommandAddAddress:
+		if err := dec.DecodeValues(&addr, &cmd.Label); err != nil {
+			return nil, fmt.Errorf("decode args failed: %w", err)
+		}
+
+		if cmd.Label == "" || len(cmd.Label) > maxLabelLength {
+			return nil, fmt.Errorf("invalid label %q", cmd.Label)
+		}
+	default:
+		return nil, fmt.Errorf("unknown command %d", cmd.Action)
+	}
+
+	a, err := mixin.MixAddressFromString(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+
+	cmd.Address = a
+	return cmd, nil
+}
+
+func EncodeCommand(cmd *Command) []byte {
+	values := []any{cmd.Address.String()}
+	if cmd.Action == CommandAddAddress {
+		values = append(values, cmd.Label)
+	}
+
+	enc := mtgpack.NewEncoder()
+	if err := enc.EncodeValues(values...); err != nil {
+		panic(err)
+	}
 
+	return append([]byte{cmd.Action}, enc.Bytes()...)
+}
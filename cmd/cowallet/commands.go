@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	backend "github.com/fox-one/cowallet"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/spf13/cast"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+// 除了 serve 以外的命令直接读写数据库，需要先停止服务
+var commands = []*command{
+	{"serve", "start the rpc server (default)", serve},
+	{"vaults list", "list all vaults", listVaults},
+	{"vaults show", "<addr> show a vault and its renewals", showVault},
+	{"renew grant", "<addr> -days 30 -reason ... grant or extend a subscription", grantRenew},
+	{"jobs list", "list pending sync jobs", listJobs},
+	{"jobs clear", "[-all] [addr...] delete sync jobs", clearJobs},
+	{"snapshots export", "<addr> [-format csv|jsonl] [-asset] [-from] [-to] [-user] [-o file] export snapshots", exportSnapshots},
+	{"db backup", "-dir dir [-incremental] | -o file back up the database", backupDB},
+	{"db restore", "-dir dir | -i file[,file...] restore backups into an empty -db directory", restoreDB},
+	{"db check", "verify checksums and decode records", checkDB},
+	{"db migrate", "[-dry-run] run pending schema migrations", migrateDB},
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return serve(ctx, args)
+	}
+
+	for _, c := range commands {
+		names := strings.Fields(c.name)
+		if len(args) < len(names) || strings.Join(args[:len(names)], " ") != c.name {
+			continue
+		}
+
+		return c.run(ctx, args[len(names):])
+	}
+
+	usage(os.Stderr)
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: cowallet [flags] <command> [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-18s %s\n", c.name, c.usage)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "flags:")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+}
+
+func openDB() (*badger.DB, error) {
+	return badger.Open(badger.DefaultOptions(cfg.dbPath).WithLoggingLevel(badger.WARNING))
+}
+
+func parseVault(args []string) (*mixin.MixAddress, error) {
+	if len(args) == 0 {
+		return nil, errors.New("vault address required")
+	}
+
+	return mixin.MixAddressFromString(args[0])
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func listVaults(ctx context.Context, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	vaults, err := backend.ListAllVaults(db)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tASSETS\tOFFSET\tUPDATED\tEXPIRED")
+	for _, v := range vaults {
+		expiredAt, err := backend.GetVaultExpiredAt(db, v.Members, v.Threshold)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n",
+			mixin.RequireNewMixAddress(v.Members, v.Threshold),
+			len(v.Assets),
+			v.Offset,
+			v.UpdatedAt.Format(time.RFC3339),
+			expiredAt.Format(time.RFC3339),
+		)
+	}
+
+	return w.Flush()
+}
+
+func showVault(ctx context.Context, args []string) error {
+	addr, err := parseVault(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	vault, err := backend.FindVault(db, addr.Members(), addr.Threshold)
+	if err != nil {
+		return err
+	}
+
+	expiredAt, err := backend.GetVaultExpiredAt(db, addr.Members(), addr.Threshold)
+	if err != nil {
+		return err
+	}
+
+	renewals, err := backend.ListRenews(db, addr.Members(), addr.Threshold, time.Time{}, uuid.Nil, 10)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(map[string]any{
+		"vault":      vault,
+		"expired_at": expiredAt,
+		"renewals":   renewals,
+	})
+}
+
+func grantRenew(ctx context.Context, args []string) error {
+	addr, err := parseVault(args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("renew grant", flag.ContinueOnError)
+	days := fs.Int("days", 30, "days to grant")
+	reason := fs.String("reason", "", "why the subscription is granted")
+	operator := fs.String("operator", os.Getenv("USER"), "operator recorded with the renewal")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *days <= 0 || *days > backend.MaxGrantDays {
+		return fmt.Errorf("days must be between 1 and %d", backend.MaxGrantDays)
+	}
+
+	if strings.TrimSpace(*reason) == "" {
+		return errors.New("reason required")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	r, err := backend.GrantRenew(db, addr.Members(), addr.Threshold, time.Duration(*days)*24*time.Hour, *reason, *operator)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
+
+func listJobs(ctx context.Context, args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	jobs, err := backend.ListJobs(db)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tUSER\tCREATED")
+	for _, job := range jobs {
+		user := "-"
+		if job.User != nil {
+			user = job.User.MixinID
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n",
+			mixin.RequireNewMixAddress(job.Members, job.Threshold),
+			user,
+			job.CreatedAt.Format(time.RFC3339),
+		)
+	}
+
+	return w.Flush()
+}
+
+func clearJobs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("jobs clear", flag.ContinueOnError)
+	all := fs.Bool("all", false, "delete all jobs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !*all && fs.NArg() == 0 {
+		return errors.New("vault address or -all required")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	var addrs []*mixin.MixAddress
+	if *all {
+		jobs, err := backend.ListJobs(db)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			addrs = append(addrs, mixin.RequireNewMixAddress(job.Members, job.Threshold))
+		}
+	}
+
+	for _, s := range fs.Args() {
+		addr, err := mixin.MixAddressFromString(s)
+		if err != nil {
+			return err
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	for _, addr := range addrs {
+		if err := backend.DeleteJob(db, addr.Members(), addr.Threshold); err != nil {
+			return err
+		}
+
+		fmt.Println("deleted", addr)
+	}
+
+	return nil
+}
+
+func exportSnapshots(ctx context.Context, args []string) error {
+	addr, err := parseVault(args)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("snapshots export", flag.ContinueOnError)
+	format := fs.String("format", backend.ExportFormatCSV, "csv or jsonl")
+	asset := fs.String("asset", "", "asset id")
+	from := fs.String("from", "", "start time")
+	to := fs.String("to", "", "end time")
+	user := fs.String("user", "", "mixin id whose address book and vault name are used")
+	output := fs.String("o", "", "output file, defaults to stdout")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	opt := &backend.ExportOptions{
+		Members:   addr.Members(),
+		Threshold: addr.Threshold,
+		AssetID:   *asset,
+		Format:    *format,
+	}
+
+	if *user != "" {
+		if opt.User, err = uuid.Parse(*user); err != nil {
+			return fmt.Errorf("invalid user: %w", err)
+		}
+	}
+
+	if *from != "" {
+		if opt.From, err = cast.ToTimeE(*from); err != nil {
+			return fmt.Errorf("invalid from: %w", err)
+		}
+	}
+
+	if *to != "" {
+		if opt.To, err = cast.ToTimeE(*to); err != nil {
+			return fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		w = f
+	}
+
+	// 离线导出不查询资产信息
+	return backend.ExportSnapshots(db, w, opt, func(string) string { return "" })
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	backend "github.com/fox-one/cowallet"
+)
+
+func backupDB(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("db backup", flag.ContinueOnError)
+	dir := fs.String("dir", "", "backup directory")
+	incremental := fs.Bool("incremental", false, "back up changes since the last backup in dir")
+	output := fs.String("o", "", "write a single full backup to this file instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if (*dir == "") == (*output == "") {
+		return errors.New("one of -dir or -o required")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if *dir != "" {
+		b, err := backend.Backup(db, *dir, *incremental)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("backup", filepath.Join(*dir, b.Name), "version", b.Version)
+		return nil
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	version, err := db.Backup(f, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	fmt.Println("backup", *output, "version", version)
+	return nil
+}
+
+func restoreDB(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("db restore", flag.ContinueOnError)
+	dir := fs.String("dir", "", "restore the latest full backup and following incremental backups in dir")
+	input := fs.String("i", "", "comma separated backup files, full backup first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var files []string
+	switch {
+	case *dir != "":
+		chain, err := backend.BackupChain(*dir)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range chain {
+			files = append(files, filepath.Join(*dir, b.Name))
+		}
+	case *input != "":
+		files = strings.Split(*input, ",")
+	default:
+		return errors.New("one of -dir or -i required")
+	}
+
+	// 只恢复到新的目录，避免和已有的数据混在一起
+	if entries, err := os.ReadDir(cfg.dbPath); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", cfg.dbPath)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if err := backend.RestoreBackups(db, files...); err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		fmt.Println("restored", name)
+	}
+
+	return nil
+}
+
+func checkDB(ctx context.Context, args []string) error {
+	db, err := badger.Open(badger.DefaultOptions(cfg.dbPath).WithLoggingLevel(badger.WARNING).WithReadOnly(true))
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	if err := db.VerifyChecksum(); err != nil {
+		return fmt.Errorf("verify checksum: %w", err)
+	}
+
+	vaults, err := backend.ListAllVaults(db)
+	if err != nil {
+		return fmt.Errorf("decode vaults: %w", err)
+	}
+
+	jobs, err := backend.ListJobs(db)
+	if err != nil {
+		return fmt.Errorf("decode jobs: %w", err)
+	}
+
+	schedules, err := backend.ListSchedules(db)
+	if err != nil {
+		return fmt.Errorf("decode schedules: %w", err)
+	}
+
+	version, err := backend.SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ok: schema %d/%d, %d vaults, %d jobs, %d schedules\n", version, backend.LatestSchemaVersion(), len(vaults), len(jobs), len(schedules))
+	return nil
+}
+
+func migrateDB(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("db migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report affected records without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	results, err := backend.Migrate(ctx, db, *dryRun)
+	for _, r := range results {
+		fmt.Printf("%d\t%s\taffected %d\t%s\n", r.Version, r.Name, r.Affected, r.Duration)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(results) == 0 {
+		fmt.Println("schema is up to date")
+	}
+
+	return nil
+}
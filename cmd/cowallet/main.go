@@ -5,18 +5,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
-	"github.com/dgraph-io/badger/v4"
 	backend "github.com/fox-one/cowallet"
 	"github.com/fox-one/mixin-sdk-go/v2"
 	"github.com/fox-one/mixin-sdk-go/v2/mixinnet"
 	"github.com/shopspring/decimal"
-	"golang.org/x/sync/errgroup"
 )
 
 var cfg struct {
@@ -25,6 +22,16 @@ var cfg struct {
 	port         int
 	payAsset     string
 	payAmount    float64
+	plansPath    string
+	reminders    string
+	currency     string
+	ratesPath    string
+	admins       string
+	metricsAddr  string
+
+	backupDir      string
+	backupInterval time.Duration
+	backupKeep     int
 }
 
 func init() {
@@ -33,7 +40,17 @@ func init() {
 	flag.IntVar(&cfg.port, "port", 8080, "http port")
 	flag.StringVar(&cfg.payAsset, "asset", "4d8c508b-91c5-375b-92b0-ee702ed2dac5", "pay asset id")
 	flag.Float64Var(&cfg.payAmount, "amount", 10, "pay amount per month")
-
+	flag.StringVar(&cfg.plansPath, "plans", "", "plans json path, overrides asset & amount")
+	flag.StringVar(&cfg.reminders, "reminders", "168h,72h,24h,0s", "remind members before subscription expires")
+	flag.StringVar(&cfg.currency, "currency", "USD", "default display currency")
+	flag.StringVar(&cfg.ratesPath, "rates", "", "fiat rates json path, units per 1 USD")
+	flag.StringVar(&cfg.backupDir, "backup-dir", "", "periodic backup directory, disabled if empty")
+	flag.DurationVar(&cfg.backupInterval, "backup-interval", backend.DefaultBackupInterval, "periodic backup interval")
+	flag.IntVar(&cfg.backupKeep, "backup-keep", backend.DefaultBackupKeep, "number of full backups to keep")
+	flag.StringVar(&cfg.admins, "admins", "", "comma separated mixin ids allowed to access /admin")
+	flag.StringVar(&cfg.metricsAddr, "metrics-addr", "127.0.0.1:9090", "internal listen address for prometheus /metrics, empty to disable")
+
+	flag.Usage = func() { usage(flag.CommandLine.Output()) }
 	flag.Parse()
 }
 
@@ -70,64 +87,89 @@ func initMixinClient(ctx context.Context) (*mixin.Client, mixinnet.Key) {
 	return client, spendKey
 }
 
-func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
-	defer stop()
-
-	client, spendKey := initMixinClient(ctx)
+func loadPlans() []*backend.Plan {
+	if cfg.plansPath == "" {
+		return []*backend.Plan{
+			{
+				ID:      "monthly",
+				AssetID: cfg.payAsset,
+				Amount:  decimal.NewFromFloat(cfg.payAmount),
+				Months:  1,
+			},
+		}
+	}
 
-	db, err := badger.Open(badger.DefaultOptions(cfg.dbPath))
+	f, err := os.Open(cfg.plansPath)
 	if err != nil {
-		slog.Error("open db failed", slog.Any("err", err))
-		return
+		panic(err)
 	}
 
-	defer db.Close()
+	defer f.Close()
 
-	slog.Info("cowallet rpc launch", "ver", "0.01")
+	var plans []*backend.Plan
+	if err := json.NewDecoder(f).Decode(&plans); err != nil {
+		panic(err)
+	}
 
-	svr := backend.NewServer(db, client, backend.Config{
-		SpendKey:   spendKey,
-		PayAssetID: cfg.payAsset,
-		PayAmount:  decimal.NewFromFloat(cfg.payAmount),
-	})
+	return plans
+}
 
-	s := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.port),
-		Handler: svr.Handler(),
+func loadRates() backend.FiatRates {
+	if cfg.ratesPath == "" {
+		return nil
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	f, err := os.Open(cfg.ratesPath)
+	if err != nil {
+		panic(err)
+	}
 
-	g.Go(func() error {
-		slog.Info("http listen", slog.String("addr", s.Addr))
-		return s.ListenAndServe()
-	})
+	defer f.Close()
 
-	g.Go(func() error {
-		<-ctx.Done()
+	var rates backend.FiatRates
+	if err := json.NewDecoder(f).Decode(&rates); err != nil {
+		panic(err)
+	}
 
-		return s.Shutdown(ctx)
-	})
+	return rates
+}
 
-	g.Go(func() error {
-		return runGC(ctx, db, time.Minute)
-	})
+func parseReminders() []time.Duration {
+	var reminders []time.Duration
+	for _, s := range strings.Split(cfg.reminders, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
 
-	g.Go(func() error {
-		return svr.Run(ctx)
-	})
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			panic(err)
+		}
 
-	_ = g.Wait()
+		reminders = append(reminders, dur)
+	}
+
+	return reminders
 }
 
-func runGC(ctx context.Context, db *badger.DB, dur time.Duration) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(dur):
-			_ = db.RunValueLogGC(0.7)
+func parseAdmins() []string {
+	var admins []string
+	for _, s := range strings.Split(cfg.admins, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			admins = append(admins, s)
 		}
 	}
+
+	return admins
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer stop()
+
+	if err := run(ctx, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stop()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	backend "github.com/fox-one/cowallet"
+	"golang.org/x/sync/errgroup"
+)
+
+func serve(ctx context.Context, args []string) error {
+	// 全局参数也可以写在 serve 后面
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+
+	client, spendKey := initMixinClient(ctx)
+
+	db, err := badger.Open(badger.DefaultOptions(cfg.dbPath))
+	if err != nil {
+		return fmt.Errorf("open db failed: %w", err)
+	}
+
+	defer db.Close()
+
+	slog.Info("cowallet rpc launch", "ver", "0.01")
+
+	svr, err := backend.NewServer(db, client, backend.Config{
+		SpendKey:  spendKey,
+		Plans:     loadPlans(),
+		Reminders: parseReminders(),
+		Currency:  cfg.currency,
+		Rates:     loadRates(),
+		Admins:    parseAdmins(),
+
+		BackupDir:      cfg.backupDir,
+		BackupInterval: cfg.backupInterval,
+		BackupKeep:     cfg.backupKeep,
+	})
+	if err != nil {
+		return err
+	}
+
+	// migration 完成之后才能处理请求
+	if err := svr.Prepare(ctx); err != nil {
+		return err
+	}
+
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.port),
+		Handler: svr.Handler(),
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		slog.Info("http listen", slog.String("addr", s.Addr))
+		if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+
+		return nil
+	})
+
+	g.Go(func() error {
+		<-ctx.Done()
+
+		return s.Shutdown(ctx)
+	})
+
+	g.Go(func() error {
+		return runGC(ctx, db, time.Minute)
+	})
+
+	// 指标只在内网地址上公开，不经过鉴权，设置为空时关闭
+	if cfg.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", backend.ServeMetrics)
+		ms := &http.Server{Addr: cfg.metricsAddr, Handler: mux}
+
+		g.Go(func() error {
+			slog.Info("metrics listen", slog.String("addr", ms.Addr))
+			if err := ms.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+
+			return nil
+		})
+
+		g.Go(func() error {
+			<-ctx.Done()
+
+			return ms.Shutdown(ctx)
+		})
+	}
+
+	g.Go(func() error {
+		return svr.Run(ctx)
+	})
+
+	// 收到退出信号时各个任务返回 context.Canceled，不算失败
+	if err := g.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	return nil
+}
+
+func runGC(ctx context.Context, db *badger.DB, dur time.Duration) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dur):
+			_ = db.RunValueLogGC(0.7)
+		}
+	}
+}
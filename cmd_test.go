@@ -0,0 +1,41 @@
+package cowallet
+
+import (
+	"testing"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+)
+
+func TestEncodeCommand(t *testing.T) {
+	addr, err := mixin.NewMixAddress([]string{
+		"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d",
+		"8017d200-7870-4b82-b53f-74bae1d2dad7",
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := EncodeCommand(&Command{
+		Action:  CommandAddAddress,
+		Address: addr,
+		Label:   "foo",
+	})
+
+	cmd, err := DecodeCommand(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Action != CommandAddAddress || cmd.Address.String() != addr.String() || cmd.Label != "foo" {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+
+	cmd, err = DecodeCommand([]byte(addr.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Action != CommandRenewVault {
+		t.Fatalf("unexpected action %d", cmd.Action)
+	}
+}
@@ -0,0 +1,165 @@
+package cowallet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	CursorDirectionNext = "next" // 更早的记录
+	CursorDirectionPrev = "prev" // 更新的记录
+
+	// count=true 时需要逐条过滤的 snapshot 最多读取的数量
+	maxCountScan = 10000
+)
+
+// SnapshotCursor 指向 snapshot 索引里的一个位置，对客户端不透明
+type SnapshotCursor struct {
+	Timestamp int64
+	ID        uuid.UUID
+}
+
+func snapshotCursorOf(s *Snapshot) *SnapshotCursor {
+	return &SnapshotCursor{
+		Timestamp: s.CreatedAt.UnixNano(),
+		ID:        s.ID,
+	}
+}
+
+func (c *SnapshotCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(buildIndexKey(nil, c.Timestamp, c.ID))
+}
+
+func ParseSnapshotCursor(s string) (*SnapshotCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var c SnapshotCursor
+	if err := decodeIndexKey(b, nil, &c.Timestamp, &c.ID); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+type SnapshotPage struct {
+	Data        []*Snapshot `json:"data"`
+	HasMore     bool        `json:"has_more"`
+	NextCursor  string      `json:"next_cursor,omitempty"`
+	PrevCursor  string      `json:"prev_cursor,omitempty"`
+	Total       *int        `json:"total,omitempty"`
+	TotalCapped bool        `json:"total_capped,omitempty"` // total 只是下限
+}
+
+// listSnapshotsByCursor 从 cursor 开始（不包含 cursor 本身）按方向读取 snapshot，
+// 返回的数据总是按时间倒序，has_more 表示这个方向上还有没有更多记录
+func listSnapshotsByCursor(txn *badger.Txn, members []string, threshold uint8, f *SnapshotFilter, cursor *SnapshotCursor, direction string, limit int) (*SnapshotPage, error) {
+	prefix, err := f.prefix(members, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	reverse := direction != CursorDirectionPrev
+
+	var seek []byte
+	switch {
+	case cursor != nil:
+		seek = buildIndexKey(slices.Clone(prefix), cursor.Timestamp, cursor.ID)
+	case reverse && !f.To.IsZero():
+		seek = buildIndexKey(slices.Clone(prefix), f.To.UnixNano())
+	case reverse:
+		// 倒序时从前缀的末尾开始
+		seek = append(slices.Clone(prefix), 0xff)
+	case !f.From.IsZero():
+		seek = buildIndexKey(slices.Clone(prefix), f.From.UnixNano())
+	default:
+		seek = prefix
+	}
+
+	page := &SnapshotPage{Data: []*Snapshot{}}
+	if err := scanSnapshots(txn, prefix, seek, reverse, f, func(key []byte, s *Snapshot) (bool, error) {
+		if cursor != nil && bytes.Equal(key, seek) {
+			return true, nil
+		}
+
+		if len(page.Data) == limit {
+			page.HasMore = true
+			return false, nil
+		}
+
+		page.Data = append(page.Data, s)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if !reverse {
+		slices.Reverse(page.Data)
+	}
+
+	if n := len(page.Data); n > 0 {
+		page.PrevCursor = snapshotCursorOf(page.Data[0]).String()
+		page.NextCursor = snapshotCursorOf(page.Data[n-1]).String()
+	}
+
+	return page, nil
+}
+
+// countSnapshots 时间范围直接比较索引里的时间，其他条件不能由索引满足时需要逐条读取过滤，
+// 最多读取 maxCountScan 条，超过时返回的数量只是下限，capped 为 true
+func countSnapshots(txn *badger.Txn, members []string, threshold uint8, f *SnapshotFilter) (n int, capped bool, err error) {
+	prefix, err := f.prefix(members, threshold)
+	if err != nil {
+		return 0, false, err
+	}
+
+	indexOnly := f.indexOnly()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var scanned int
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var (
+			ts int64
+			id uuid.UUID
+		)
+
+		if err := decodeIndexKey(it.Item().Key(), prefix, &ts, &id); err != nil {
+			return 0, false, err
+		}
+
+		if (!f.From.IsZero() && ts < f.From.UnixNano()) || (!f.To.IsZero() && ts >= f.To.UnixNano()) {
+			continue
+		}
+
+		if indexOnly {
+			n++
+			continue
+		}
+
+		if scanned++; scanned > maxCountScan {
+			return n, true, nil
+		}
+
+		s, err := findSnapshot(txn, id)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if f.match(s) {
+			n++
+		}
+	}
+
+	return n, false, nil
+}
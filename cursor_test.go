@@ -0,0 +1,95 @@
+package cowallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestListSnapshotsByCursor(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		now       = time.Now()
+	)
+
+	// 前三条 snapshot 的时间完全相同
+	times := []time.Time{now, now, now, now.Add(time.Second), now.Add(2 * time.Second)}
+	if err := db.Update(func(txn *badger.Txn) error {
+		for _, ts := range times {
+			if err := saveSnapshot(txn, &Snapshot{
+				ID:        uuid.New(),
+				CreatedAt: ts,
+				AssetID:   "965e5c6e-434c-3fa9-b780-c50f43cd955c",
+				Amount:    decimal.NewFromInt(1),
+			}, members, threshold); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	var (
+		cursor *SnapshotCursor
+		seen   = map[uuid.UUID]bool{}
+		pages  []*SnapshotPage
+	)
+
+	for {
+		page, err := listSnapshotsByCursor(txn, members, threshold, &SnapshotFilter{}, cursor, CursorDirectionNext, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages = append(pages, page)
+		for i, s := range page.Data {
+			if seen[s.ID] {
+				t.Fatalf("duplicated snapshot %s", s.ID)
+			}
+
+			if i > 0 && s.CreatedAt.After(page.Data[i-1].CreatedAt) {
+				t.Fatal("snapshots should be in descending order")
+			}
+
+			seen[s.ID] = true
+		}
+
+		if !page.HasMore {
+			break
+		}
+
+		if cursor, err = ParseSnapshotCursor(page.NextCursor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(seen) != len(times) || len(pages) != 3 {
+		t.Fatalf("want %d snapshots in 3 pages, got %d in %d", len(times), len(seen), len(pages))
+	}
+
+	// 从最后一页往回翻，得到上一页相同的数据
+	cursor, _ = ParseSnapshotCursor(pages[2].PrevCursor)
+	prev, err := listSnapshotsByCursor(txn, members, threshold, &SnapshotFilter{}, cursor, CursorDirectionPrev, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !prev.HasMore || len(prev.Data) != 2 || prev.Data[0].ID != pages[1].Data[0].ID || prev.Data[1].ID != pages[1].Data[1].ID {
+		t.Fatalf("unexpected prev page %+v", prev)
+	}
+
+	if n, capped, err := countSnapshots(txn, members, threshold, &SnapshotFilter{}); err != nil || capped || n != len(times) {
+		t.Fatalf("count snapshots: %d, %v", n, err)
+	}
+}
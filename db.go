@@ -1,8 +1,12 @@
 package cowallet
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"log/slog"
+	"slices"
 	"sort"
 	"time"
 
@@ -18,12 +22,37 @@ var (
 	snapshotPrefix                = []byte("s:")
 	snapshotVaultIndexPrefix      = []byte("sv:")
 	snapshotVaultAssetIndexPrefix = []byte("sva:")
+	snapshotOpponentIndexPrefix   = []byte("svo:")
+	snapshotTxIndexPrefix         = []byte("svt:")
+	snapshotDirectionIndexPrefix  = []byte("svd:")
 	propertyPrefix                = []byte("p:")
 	outputPrefix                  = []byte("o:")
 	addressPrefix                 = []byte("a:")
 	renewPrefix                   = []byte("r:")
 	renewVaultIndexPrefix         = []byte("rv:")
+	renewExpiryPrefix             = []byte("re:")
 	remarkPrefix                  = []byte("rm:")
+	requestPrefix                 = []byte("mr:")
+	requestVaultIndexPrefix       = []byte("mrv:")
+	requestOpenIndexPrefix        = []byte("mro:")
+	refundPrefix                  = []byte("rf:")
+	invoicePrefix                 = []byte("i:")
+	webhookPrefix                 = []byte("wh:")
+	webhookVaultIndexPrefix       = []byte("whv:")
+	deliveryPrefix                = []byte("wd:")
+	deliveryQueueIndexPrefix      = []byte("wdq:")
+	deliveryWebhookIndexPrefix    = []byte("wdw:")
+	notificationPrefix            = []byte("n:")
+	notificationSettingPrefix     = []byte("ns:")
+	reminderPrefix                = []byte("rd:")
+	sessionPrefix                 = []byte("se:")
+	credentialPrefix              = []byte("cr:")
+	schedulePrefix                = []byte("sc:")
+	utxoPrefix                    = []byte("u:")
+	vaultEventPrefix              = []byte("ve:")
+	vaultEventSeqPrefix           = []byte("ves:")
+	checkpointPrefix              = []byte("bc:")
+	planPrefix                    = []byte("pl:")
 )
 
 func hashMembers(ids []string, threshold uint8) uuid.UUID {
@@ -78,6 +107,12 @@ func saveSnapshot(txn *badger.Txn, s *Snapshot, members []string, threshold uint
 		}
 	}
 
+	for _, key := range snapshotFilterIndexKeys(hashMembers(members, threshold), s) {
+		if err := txn.Set(key, nil); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -98,48 +133,37 @@ func findSnapshot(txn *badger.Txn, id uuid.UUID) (*Snapshot, error) {
 	return &s, nil
 }
 
-func listSnapshots(txn *badger.Txn, members []string, threshold uint8, assetID string, offset time.Time, limit int) ([]*Snapshot, error) {
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchSize = limit
-	opts.Reverse = true
-
-	it := txn.NewIterator(opts)
-	defer it.Close()
+// snapshotIndexPrefix 返回 vault 的 snapshot 索引前缀，指定资产时使用 sva: 索引
+func snapshotIndexPrefix(members []string, threshold uint8, assetID string) ([]byte, error) {
+	if assetID == "" {
+		return buildIndexKey(snapshotVaultIndexPrefix, hashMembers(members, threshold)), nil
+	}
 
-	prefix := snapshotVaultIndexPrefix
-	args := []any{hashMembers(members, threshold)}
+	asset, err := uuid.Parse(assetID)
+	if err != nil {
+		return nil, err
+	}
 
-	if assetID != "" {
-		asset, err := uuid.Parse(assetID)
-		if err != nil {
-			return nil, err
-		}
+	return buildIndexKey(snapshotVaultAssetIndexPrefix, hashMembers(members, threshold), asset), nil
+}
 
-		prefix = snapshotVaultAssetIndexPrefix
-		args = append(args, asset)
+func listSnapshots(txn *badger.Txn, members []string, threshold uint8, f *SnapshotFilter, offset time.Time, limit int) ([]*Snapshot, error) {
+	prefix, err := f.prefix(members, threshold)
+	if err != nil {
+		return nil, err
 	}
 
-	prefix = buildIndexKey(prefix, args...)
-
 	ts := offset.UnixNano()
 	if ts <= 0 {
 		ts = time.Now().UnixNano()
 	}
 
-	it.Seek(buildIndexKey(prefix, ts))
 	snapshots := []*Snapshot{}
-	for ; it.ValidForPrefix(prefix) && len(snapshots) < limit; it.Next() {
-		key := it.Item().Key()
-
-		var id uuid.UUID
-		decodeIndexKey(key, prefix, &ts, &id)
-
-		s, err := findSnapshot(txn, id)
-		if err != nil {
-			return nil, err
-		}
-
+	if err := scanSnapshots(txn, prefix, buildIndexKey(slices.Clone(prefix), ts), true, f, func(_ []byte, s *Snapshot) (bool, error) {
 		snapshots = append(snapshots, s)
+		return len(snapshots) < limit, nil
+	}); err != nil {
+		return nil, err
 	}
 
 	return snapshots, nil
@@ -182,6 +206,39 @@ func listJobs(txn *badger.Txn) ([]*Job, error) {
 	return jobs, nil
 }
 
+func findJobExpiredAt(txn *badger.Txn, members []string, threshold uint8) (time.Time, error) {
+	item, err := txn.Get(buildIndexKey(jobPrefix, hashMembers(members, threshold)))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return time.Time{}, nil
+		}
+
+		return time.Time{}, err
+	}
+
+	return time.Unix(int64(item.ExpiresAt()), 0), nil
+}
+
+func findJob(txn *badger.Txn, members []string, threshold uint8) (*Job, error) {
+	item, err := txn.Get(buildIndexKey(jobPrefix, hashMembers(members, threshold)))
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &job)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func deleteJob(txn *badger.Txn, members []string, threshold uint8) error {
+	return txn.Delete(buildIndexKey(jobPrefix, hashMembers(members, threshold)))
+}
+
 func ListJobs(db *badger.DB) ([]*Job, error) {
 	txn := db.NewTransaction(false)
 	defer txn.Discard()
@@ -224,18 +281,25 @@ func saveVault(txn *badger.Txn, vault *Vault) error {
 	return txn.SetEntry(e)
 }
 
+// findVault vault 还没有保存时返回一个空的 vault
 func findVault(txn *badger.Txn, members []string, threshold uint8) (*Vault, error) {
+	vault, err := findSavedVault(txn, members, threshold)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return &Vault{
+			Members:   members,
+			Threshold: threshold,
+		}, nil
+	}
+
+	return vault, err
+}
+
+// findSavedVault vault 还没有保存时返回 badger.ErrKeyNotFound
+func findSavedVault(txn *badger.Txn, members []string, threshold uint8) (*Vault, error) {
 	pk := buildIndexKey(vaultPrefix, hashMembers(members, threshold))
 
 	item, err := txn.Get(pk)
 	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			return &Vault{
-				Members:   members,
-				Threshold: threshold,
-			}, nil
-		}
-
 		return nil, err
 	}
 
@@ -294,12 +358,40 @@ func listVaults(txn *badger.Txn, user string) ([]*Vault, error) {
 	return vaults, nil
 }
 
+func listAllVaults(txn *badger.Txn) ([]*Vault, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var vaults []*Vault
+	for it.Seek(vaultPrefix); it.ValidForPrefix(vaultPrefix); it.Next() {
+		var vault Vault
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &vault)
+		}); err != nil {
+			return nil, err
+		}
+
+		vaults = append(vaults, &vault)
+	}
+
+	return vaults, nil
+}
+
+func ListAllVaults(db *badger.DB) ([]*Vault, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	return listAllVaults(txn)
+}
+
 func readProperty(txn *badger.Txn, key string, val any) error {
 	item, err := txn.Get(buildIndexKey(propertyPrefix, key))
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
 			return nil
 		}
+
+		return err
 	}
 
 	return item.Value(func(b []byte) error {
@@ -327,7 +419,11 @@ func SaveProperty(db *badger.DB, key string, val any) error {
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
 
-	return saveProperty(txn, key, val)
+	if err := saveProperty(txn, key, val); err != nil {
+		return err
+	}
+
+	return txn.Commit()
 }
 
 func saveRenew(txn *badger.Txn, r *Renew) error {
@@ -356,6 +452,20 @@ func saveRenew(txn *badger.Txn, r *Renew) error {
 		}
 	}
 
+	// expiry
+	{
+		v, err := findVaultExpiry(txn, r.Members, r.Threshold)
+		if err != nil {
+			return err
+		}
+
+		v.ExpiredAt = maxDate(v.ExpiredAt, r.To)
+		v.Sequence = max(v.Sequence, r.Sequence)
+		if err := saveVaultExpiry(txn, r.Members, r.Threshold, v); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -379,7 +489,9 @@ func findRenew(txn *badger.Txn, id uuid.UUID) (*Renew, error) {
 	return &r, nil
 }
 
-func lastRenew(txn *badger.Txn, members []string, threshold uint8) (*Renew, error) {
+// listRenews 按时间倒序返回 offset 之前的续费记录，after 为上一页最后一条记录的 id，
+// 和 offset 一起确定上一页的位置，时间相同的记录不会被跳过；after 为空时不包含 offset 这一时刻
+func listRenews(txn *badger.Txn, members []string, threshold uint8, offset time.Time, after uuid.UUID, limit int) ([]*Renew, error) {
 	opt := badger.DefaultIteratorOptions
 	opt.Reverse = true
 	opt.PrefetchValues = false
@@ -389,31 +501,148 @@ func lastRenew(txn *badger.Txn, members []string, threshold uint8) (*Renew, erro
 
 	prefix := buildIndexKey(renewVaultIndexPrefix, hashMembers(members, threshold))
 
-	ts := time.Now().UnixNano()
-	it.Seek(buildIndexKey(prefix, ts))
-	if !it.ValidForPrefix(prefix) {
-		return nil, badger.ErrKeyNotFound
+	ts := offset.UnixNano()
+	if ts <= 0 {
+		ts = time.Now().UnixNano()
+		after = uuid.Nil
 	}
 
-	var id uuid.UUID
-	if err := decodeIndexKey(it.Item().Key(), prefix, &ts, &id); err != nil {
-		return nil, err
+	start := buildIndexKey(slices.Clone(prefix), ts)
+	if after != uuid.Nil {
+		start = buildIndexKey(start, after)
+	}
+
+	renews := []*Renew{}
+	for it.Seek(start); it.ValidForPrefix(prefix) && len(renews) < limit; it.Next() {
+		if bytes.Equal(it.Item().Key(), start) {
+			continue
+		}
+
+		var id uuid.UUID
+		if err := decodeIndexKey(it.Item().Key(), prefix, &ts, &id); err != nil {
+			return nil, err
+		}
+
+		r, err := findRenew(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		renews = append(renews, r)
 	}
 
-	return findRenew(txn, id)
+	return renews, nil
 }
 
-func getVaultExpiredAt(txn *badger.Txn, members []string, threshold uint8) (time.Time, uint64, error) {
-	r, err := lastRenew(txn, members, threshold)
+func saveVaultExpiry(txn *badger.Txn, members []string, threshold uint8, v *VaultExpiry) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(renewExpiryPrefix, hashMembers(members, threshold)), b)
+}
+
+// findVaultExpiry 没有续费记录时返回空的 VaultExpiry
+func findVaultExpiry(txn *badger.Txn, members []string, threshold uint8) (*VaultExpiry, error) {
+	item, err := txn.Get(buildIndexKey(renewExpiryPrefix, hashMembers(members, threshold)))
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
-			return time.Time{}, 0, nil
+			return &VaultExpiry{}, nil
 		}
 
+		return nil, err
+	}
+
+	var v VaultExpiry
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &v)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// getVaultExpiredAt 返回所有续费里最晚的到期时间和最大的 sequence，保存续费时更新
+func getVaultExpiredAt(txn *badger.Txn, members []string, threshold uint8) (time.Time, uint64, error) {
+	v, err := findVaultExpiry(txn, members, threshold)
+	if err != nil {
 		return time.Time{}, 0, err
 	}
 
-	return r.To, r.Sequence, nil
+	return v.ExpiredAt, v.Sequence, nil
+}
+
+// backfillVaultExpiry 根据已有的续费记录补上每个 vault 的到期时间，
+// 付款的续费按 output 的时间索引，可能排在之后才处理的手动授予前面，所以要看全部续费
+func backfillVaultExpiry(ctx context.Context, db *badger.DB, dryRun bool) (int, error) {
+	type vaultExpiry struct {
+		members   []string
+		threshold uint8
+		expiry    VaultExpiry
+	}
+
+	expiries := map[uuid.UUID]*vaultExpiry{}
+	if err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(renewPrefix); it.ValidForPrefix(renewPrefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var r Renew
+			if err := it.Item().Value(func(b []byte) error {
+				return json.Unmarshal(b, &r)
+			}); err != nil {
+				return err
+			}
+
+			id := hashMembers(r.Members, r.Threshold)
+			v, ok := expiries[id]
+			if !ok {
+				v = &vaultExpiry{members: r.Members, threshold: r.Threshold}
+				expiries[id] = v
+			}
+
+			v.expiry.ExpiredAt = maxDate(v.expiry.ExpiredAt, r.To)
+			v.expiry.Sequence = max(v.expiry.Sequence, r.Sequence)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if !dryRun {
+		for _, v := range expiries {
+			if err := db.Update(func(txn *badger.Txn) error {
+				return saveVaultExpiry(txn, v.members, v.threshold, &v.expiry)
+			}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	slog.Info("backfill vault expiry", "count", len(expiries), "dry_run", dryRun)
+	return len(expiries), nil
+}
+
+func GetVaultExpiredAt(db *badger.DB, members []string, threshold uint8) (time.Time, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	expiredAt, _, err := getVaultExpiredAt(txn, members, threshold)
+	return expiredAt, err
+}
+
+func ListRenews(db *badger.DB, members []string, threshold uint8, offset time.Time, after uuid.UUID, limit int) ([]*Renew, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	return listRenews(txn, members, threshold, offset, after, limit)
 }
 
 func saveAddress(txn *badger.Txn, v Address) error {
@@ -513,3 +742,865 @@ func getRemarkName(txn *badger.Txn, user uuid.UUID, members []string, threshold
 
 	return r.Name, nil
 }
+
+func saveMultisigRequest(txn *badger.Txn, r *MultisigRequest) error {
+	pk := buildIndexKey(requestPrefix, r.ID)
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := txn.Set(pk, b); err != nil {
+		return err
+	}
+
+	vault := hashMembers(r.Members, r.Threshold)
+
+	// index
+	{
+		key := buildIndexKey(
+			requestVaultIndexPrefix,
+			vault,
+			r.CreatedAt.UnixNano(),
+			r.ID,
+		)
+
+		if err := txn.Set(key, nil); err != nil {
+			return err
+		}
+	}
+
+	// open requests
+	{
+		key := buildIndexKey(requestOpenIndexPrefix, vault, r.ID)
+		if r.IsOpen() {
+			if err := txn.Set(key, nil); err != nil {
+				return err
+			}
+		} else if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findMultisigRequest(txn *badger.Txn, id uuid.UUID) (*MultisigRequest, error) {
+	item, err := txn.Get(buildIndexKey(requestPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var r MultisigRequest
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &r)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func listMultisigRequests(txn *badger.Txn, members []string, threshold uint8, offset time.Time, limit int) ([]*MultisigRequest, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := buildIndexKey(requestVaultIndexPrefix, hashMembers(members, threshold))
+
+	ts := offset.UnixNano()
+	if ts <= 0 {
+		ts = time.Now().UnixNano()
+	}
+
+	it.Seek(buildIndexKey(prefix, ts))
+	requests := []*MultisigRequest{}
+	for ; it.ValidForPrefix(prefix) && len(requests) < limit; it.Next() {
+		var id uuid.UUID
+		if err := decodeIndexKey(it.Item().Key(), prefix, &ts, &id); err != nil {
+			return nil, err
+		}
+
+		r, err := findMultisigRequest(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, r)
+	}
+
+	return requests, nil
+}
+
+func listOpenMultisigRequests(txn *badger.Txn, members []string, threshold uint8) ([]*MultisigRequest, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := buildIndexKey(requestOpenIndexPrefix, hashMembers(members, threshold))
+
+	var requests []*MultisigRequest
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var id uuid.UUID
+		if err := decodeIndexKey(it.Item().Key(), prefix, &id); err != nil {
+			return nil, err
+		}
+
+		r, err := findMultisigRequest(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, r)
+	}
+
+	return requests, nil
+}
+
+func saveRefund(txn *badger.Txn, r *Refund) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(refundPrefix, r.ID), b)
+}
+
+func findRefund(txn *badger.Txn, id uuid.UUID) (*Refund, error) {
+	item, err := txn.Get(buildIndexKey(refundPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var r Refund
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &r)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func saveInvoice(txn *badger.Txn, v *Invoice) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(invoicePrefix, v.ID), b)
+}
+
+func findInvoice(txn *badger.Txn, id uuid.UUID) (*Invoice, error) {
+	item, err := txn.Get(buildIndexKey(invoicePrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var v Invoice
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &v)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func saveWebhook(txn *badger.Txn, w *Webhook) error {
+	b, err := json.Marshal(w)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := txn.Set(buildIndexKey(webhookPrefix, w.ID), b); err != nil {
+		return err
+	}
+
+	key := buildIndexKey(webhookVaultIndexPrefix, hashMembers(w.Members, w.Threshold), w.ID)
+	return txn.Set(key, nil)
+}
+
+func deleteWebhook(txn *badger.Txn, w *Webhook) error {
+	if err := txn.Delete(buildIndexKey(webhookPrefix, w.ID)); err != nil {
+		return err
+	}
+
+	key := buildIndexKey(webhookVaultIndexPrefix, hashMembers(w.Members, w.Threshold), w.ID)
+	return txn.Delete(key)
+}
+
+func findWebhook(txn *badger.Txn, id uuid.UUID) (*Webhook, error) {
+	item, err := txn.Get(buildIndexKey(webhookPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var w Webhook
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &w)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func listWebhooks(txn *badger.Txn, members []string, threshold uint8) ([]*Webhook, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := buildIndexKey(webhookVaultIndexPrefix, hashMembers(members, threshold))
+
+	webhooks := []*Webhook{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var id uuid.UUID
+		if err := decodeIndexKey(it.Item().Key(), prefix, &id); err != nil {
+			return nil, err
+		}
+
+		w, err := findWebhook(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, nil
+}
+
+// saveDelivery 保存投递记录，未完成的记录按下次投递时间放进队列，
+// 投递成功或者最终失败的记录和日志索引在 webhookDeliveryTTL 之后过期
+func saveDelivery(txn *badger.Txn, d *WebhookDelivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		panic(err)
+	}
+
+	entry := func(key, value []byte) *badger.Entry {
+		e := badger.NewEntry(key, value)
+		if d.State != WebhookDeliveryStatePending {
+			e = e.WithTTL(webhookDeliveryTTL)
+		}
+
+		return e
+	}
+
+	if err := txn.SetEntry(entry(buildIndexKey(deliveryPrefix, d.ID), b)); err != nil {
+		return err
+	}
+
+	// log index
+	{
+		key := buildIndexKey(deliveryWebhookIndexPrefix, d.Webhook, d.CreatedAt.UnixNano(), d.ID)
+		if err := txn.SetEntry(entry(key, nil)); err != nil {
+			return err
+		}
+	}
+
+	// queue index
+	if d.State == WebhookDeliveryStatePending {
+		key := buildIndexKey(deliveryQueueIndexPrefix, d.NextAttemptAt.UnixNano(), d.ID)
+		if err := txn.Set(key, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dequeueDelivery 在修改 NextAttemptAt 之前把记录移出队列
+func dequeueDelivery(txn *badger.Txn, d *WebhookDelivery) error {
+	return txn.Delete(buildIndexKey(deliveryQueueIndexPrefix, d.NextAttemptAt.UnixNano(), d.ID))
+}
+
+func findDelivery(txn *badger.Txn, id uuid.UUID) (*WebhookDelivery, error) {
+	item, err := txn.Get(buildIndexKey(deliveryPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var d WebhookDelivery
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &d)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func listDueDeliveries(txn *badger.Txn, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := deliveryQueueIndexPrefix
+
+	var deliveries []*WebhookDelivery
+	for it.Seek(prefix); it.ValidForPrefix(prefix) && len(deliveries) < limit; it.Next() {
+		var (
+			ts int64
+			id uuid.UUID
+		)
+
+		if err := decodeIndexKey(it.Item().Key(), prefix, &ts, &id); err != nil {
+			return nil, err
+		}
+
+		if ts > now.UnixNano() {
+			break
+		}
+
+		d, err := findDelivery(txn, id)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+func listDeliveries(txn *badger.Txn, webhook uuid.UUID, offset time.Time, limit int) ([]*WebhookDelivery, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := buildIndexKey(deliveryWebhookIndexPrefix, webhook)
+
+	ts := offset.UnixNano()
+	if ts <= 0 {
+		ts = time.Now().UnixNano()
+	}
+
+	it.Seek(buildIndexKey(prefix, ts))
+	deliveries := []*WebhookDelivery{}
+	for ; it.ValidForPrefix(prefix) && len(deliveries) < limit; it.Next() {
+		var id uuid.UUID
+		if err := decodeIndexKey(it.Item().Key(), prefix, &ts, &id); err != nil {
+			return nil, err
+		}
+
+		d, err := findDelivery(txn, id)
+		if err != nil {
+			// 记录和日志索引的过期时间可能相差一点
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+func notificationKey(n *Notification) []byte {
+	at := n.NextAttemptAt
+	if at.IsZero() {
+		at = n.CreatedAt
+	}
+
+	return buildIndexKey(notificationPrefix, at.UnixNano(), n.ID)
+}
+
+func saveNotification(txn *badger.Txn, n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(notificationKey(n), b)
+}
+
+func deleteNotification(txn *badger.Txn, n *Notification) error {
+	return txn.Delete(notificationKey(n))
+}
+
+// listNotifications 按发送时间排队，只返回 now 之前到期的通知
+func listNotifications(txn *badger.Txn, now time.Time, limit int) ([]*Notification, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = limit
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var notifications []*Notification
+	for it.Seek(notificationPrefix); it.ValidForPrefix(notificationPrefix) && len(notifications) < limit; it.Next() {
+		var (
+			ts int64
+			id uuid.UUID
+		)
+
+		if err := decodeIndexKey(it.Item().Key(), notificationPrefix, &ts, &id); err != nil {
+			return nil, err
+		}
+
+		if ts > now.UnixNano() {
+			break
+		}
+
+		var n Notification
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &n)
+		}); err != nil {
+			return nil, err
+		}
+
+		notifications = append(notifications, &n)
+	}
+
+	return notifications, nil
+}
+
+func saveNotificationSetting(txn *badger.Txn, v *NotificationSetting) error {
+	k := buildIndexKey(notificationSettingPrefix, v.User)
+	if !v.Disabled {
+		return txn.Delete(k)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(k, b)
+}
+
+func getNotificationSetting(txn *badger.Txn, user uuid.UUID) (*NotificationSetting, error) {
+	item, err := txn.Get(buildIndexKey(notificationSettingPrefix, user))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return &NotificationSetting{User: user}, nil
+		}
+
+		return nil, err
+	}
+
+	var v NotificationSetting
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &v)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func hasReminder(txn *badger.Txn, members []string, threshold uint8, expiredAt time.Time, offset time.Duration) (bool, error) {
+	key := buildIndexKey(reminderPrefix, hashMembers(members, threshold), expiredAt.UnixNano(), int64(offset))
+	if _, err := txn.Get(key); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func saveReminder(txn *badger.Txn, members []string, threshold uint8, expiredAt time.Time, offset time.Duration) error {
+	key := buildIndexKey(reminderPrefix, hashMembers(members, threshold), expiredAt.UnixNano(), int64(offset))
+	return txn.Set(key, nil)
+}
+
+func saveSession(txn *badger.Txn, v *Session) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	e := badger.NewEntry(buildIndexKey(sessionPrefix, v.ID), b).WithTTL(time.Until(v.ExpiredAt))
+	return txn.SetEntry(e)
+}
+
+func findSession(txn *badger.Txn, id uuid.UUID) (*Session, error) {
+	item, err := txn.Get(buildIndexKey(sessionPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var v Session
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &v)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func saveCredential(txn *badger.Txn, v *Credential) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(credentialPrefix, v.UserID), b)
+}
+
+func findCredential(txn *badger.Txn, user uuid.UUID) (*Credential, error) {
+	item, err := txn.Get(buildIndexKey(credentialPrefix, user))
+	if err != nil {
+		return nil, err
+	}
+
+	var v Credential
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &v)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func deleteCredential(txn *badger.Txn, user uuid.UUID) error {
+	return txn.Delete(buildIndexKey(credentialPrefix, user))
+}
+
+func saveSchedule(txn *badger.Txn, v *Schedule) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(schedulePrefix, hashMembers(v.Members, v.Threshold)), b)
+}
+
+func findSchedule(txn *badger.Txn, members []string, threshold uint8) (*Schedule, error) {
+	item, err := txn.Get(buildIndexKey(schedulePrefix, hashMembers(members, threshold)))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return &Schedule{
+				Members:   members,
+				Threshold: threshold,
+			}, nil
+		}
+
+		return nil, err
+	}
+
+	var v Schedule
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &v)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func deleteSchedule(txn *badger.Txn, members []string, threshold uint8) error {
+	return txn.Delete(buildIndexKey(schedulePrefix, hashMembers(members, threshold)))
+}
+
+func FindSchedule(db *badger.DB, members []string, threshold uint8) (*Schedule, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	return findSchedule(txn, members, threshold)
+}
+
+func listSchedules(txn *badger.Txn) ([]*Schedule, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var schedules []*Schedule
+	for it.Seek(schedulePrefix); it.ValidForPrefix(schedulePrefix); it.Next() {
+		var v Schedule
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &v)
+		}); err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, &v)
+	}
+
+	return schedules, nil
+}
+
+func ListSchedules(db *badger.DB) ([]*Schedule, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	return listSchedules(txn)
+}
+
+func saveUtxo(txn *badger.Txn, members []string, threshold uint8, u *Utxo) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(utxoPrefix, hashMembers(members, threshold), u.ID), b)
+}
+
+func deleteUtxo(txn *badger.Txn, members []string, threshold uint8, id uuid.UUID) error {
+	return txn.Delete(buildIndexKey(utxoPrefix, hashMembers(members, threshold), id))
+}
+
+func findUtxo(txn *badger.Txn, members []string, threshold uint8, id uuid.UUID) (*Utxo, error) {
+	item, err := txn.Get(buildIndexKey(utxoPrefix, hashMembers(members, threshold), id))
+	if err != nil {
+		return nil, err
+	}
+
+	var u Utxo
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &u)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func listUtxos(txn *badger.Txn, members []string, threshold uint8) ([]*Utxo, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var utxos []*Utxo
+	prefix := buildIndexKey(utxoPrefix, hashMembers(members, threshold))
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var u Utxo
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &u)
+		}); err != nil {
+			return nil, err
+		}
+
+		utxos = append(utxos, &u)
+	}
+
+	return utxos, nil
+}
+
+func lastVaultEventID(txn *badger.Txn, members []string, threshold uint8) (uint64, error) {
+	item, err := txn.Get(buildIndexKey(vaultEventSeqPrefix, hashMembers(members, threshold)))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	var id uint64
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &id)
+	}); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// saveVaultEvent 分配递增的 id 并保存事件，事件在 ttl 之后过期
+func saveVaultEvent(txn *badger.Txn, members []string, threshold uint8, e *VaultEvent, ttl time.Duration) error {
+	id, err := lastVaultEventID(txn, members, threshold)
+	if err != nil {
+		return err
+	}
+
+	e.ID = id + 1
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+
+	vaultID := hashMembers(members, threshold)
+	if err := txn.SetEntry(badger.NewEntry(buildIndexKey(vaultEventPrefix, vaultID, e.ID), b).WithTTL(ttl)); err != nil {
+		return err
+	}
+
+	seq, _ := json.Marshal(e.ID)
+	return txn.Set(buildIndexKey(vaultEventSeqPrefix, vaultID), seq)
+}
+
+func listVaultEvents(txn *badger.Txn, members []string, threshold uint8, after uint64, limit int) ([]*VaultEvent, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := buildIndexKey(vaultEventPrefix, hashMembers(members, threshold))
+	it.Seek(buildIndexKey(prefix, after+1))
+
+	events := []*VaultEvent{}
+	for ; it.ValidForPrefix(prefix) && len(events) < limit; it.Next() {
+		var e VaultEvent
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &e)
+		}); err != nil {
+			return nil, err
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, nil
+}
+
+// saveCheckpoints 覆盖 vault 当天的余额，已经不再持有的资产会被删除
+func saveCheckpoints(txn *badger.Txn, members []string, threshold uint8, date string, checkpoints []*BalanceCheckpoint) error {
+	old, err := listCheckpoints(txn, members, threshold, date)
+	if err != nil {
+		return err
+	}
+
+	vault := hashMembers(members, threshold)
+	for _, c := range old {
+		if err := txn.Delete(buildIndexKey(checkpointPrefix, vault, date, uuid.MustParse(c.AssetID))); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range checkpoints {
+		b, err := json.Marshal(c)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := txn.Set(buildIndexKey(checkpointPrefix, vault, date, uuid.MustParse(c.AssetID)), b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listCheckpoints(txn *badger.Txn, members []string, threshold uint8, date string) ([]*BalanceCheckpoint, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	checkpoints := []*BalanceCheckpoint{}
+	prefix := buildIndexKey(checkpointPrefix, hashMembers(members, threshold), date)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var c BalanceCheckpoint
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &c)
+		}); err != nil {
+			return nil, err
+		}
+
+		checkpoints = append(checkpoints, &c)
+	}
+
+	return checkpoints, nil
+}
+
+// lastCheckpointDate 返回不晚于 date 的最近一次记录的日期，没有记录时返回空
+func lastCheckpointDate(txn *badger.Txn, members []string, threshold uint8, date string) (string, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := buildIndexKey(checkpointPrefix, hashMembers(members, threshold))
+	it.Seek(buildIndexKey(slices.Clone(prefix), date, uuid.Max))
+	if !it.ValidForPrefix(prefix) {
+		return "", nil
+	}
+
+	var last string
+	if err := decodeIndexKey(it.Item().Key(), prefix, &last); err != nil {
+		return "", err
+	}
+
+	return last, nil
+}
+
+// walkCheckpoints 按日期顺序遍历 [from, to] 之间的记录
+func walkCheckpoints(txn *badger.Txn, members []string, threshold uint8, from, to string, fn func(c *BalanceCheckpoint) error) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := buildIndexKey(checkpointPrefix, hashMembers(members, threshold))
+	for it.Seek(buildIndexKey(slices.Clone(prefix), from)); it.ValidForPrefix(prefix); it.Next() {
+		var c BalanceCheckpoint
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &c)
+		}); err != nil {
+			return err
+		}
+
+		if c.Date > to {
+			break
+		}
+
+		if err := fn(&c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func savePlan(txn *badger.Txn, p *Plan) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+
+	return txn.Set(buildIndexKey(planPrefix, p.ID, p.Version), b)
+}
+
+func findPlanVersion(txn *badger.Txn, id string, version int64) (*Plan, error) {
+	item, err := txn.Get(buildIndexKey(planPrefix, id, version))
+	if err != nil {
+		return nil, err
+	}
+
+	var p Plan
+	if err := item.Value(func(b []byte) error {
+		return json.Unmarshal(b, &p)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// listPlanVersions 按版本顺序返回套餐的所有版本
+func listPlanVersions(txn *badger.Txn, id string) ([]*Plan, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	plans := []*Plan{}
+	prefix := buildIndexKey(planPrefix, id)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var p Plan
+		if err := it.Item().Value(func(b []byte) error {
+			return json.Unmarshal(b, &p)
+		}); err != nil {
+			return nil, err
+		}
+
+		plans = append(plans, &p)
+	}
+
+	return plans, nil
+}
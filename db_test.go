@@ -0,0 +1,61 @@
+package cowallet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
+)
+
+// newTestDB 打开一个内存数据库，测试结束时自动关闭
+func newTestDB(t *testing.T) *badger.DB {
+	t.Helper()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return db
+}
+
+// newTestServer 没有配置套餐时使用一个按月付费的测试套餐
+func newTestServer(t *testing.T, db *badger.DB, cfg Config) Server {
+	t.Helper()
+
+	if len(cfg.Plans) == 0 {
+		cfg.Plans = []*Plan{
+			{ID: "monthly", AssetID: "4d8c508b-91c5-375b-92b0-ee702ed2dac5", Amount: decimal.NewFromInt(10), Months: 1},
+		}
+	}
+
+	s, err := NewServer(db, &mixin.Client{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// serveAs 以 user 的身份调用 handler，pattern 为 chi 路由
+func serveAs(h http.HandlerFunc, pattern, user, target string) *httptest.ResponseRecorder {
+	m := chi.NewMux()
+	m.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), &User{MixinID: user})))
+		})
+	})
+	m.Get(pattern, h)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
@@ -0,0 +1,196 @@
+package cowallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/twitchtv/twirp"
+)
+
+const (
+	// 事件保留的时间，断线超过这个时间需要重新拉取 vault
+	vaultEventTTL       = 24 * time.Hour
+	vaultEventHeartbeat = 15 * time.Second
+)
+
+// eventHub 在 handleJob 提交之后唤醒订阅了对应 vault 的连接，事件本身从数据库读取
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan struct{}]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[uuid.UUID]map[chan struct{}]struct{}{}}
+}
+
+func (h *eventHub) subscribe(members []string, threshold uint8) (<-chan struct{}, func()) {
+	id := hashMembers(slices.Clone(members), threshold)
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	if h.subs[id] == nil {
+		h.subs[id] = map[chan struct{}]struct{}{}
+	}
+	h.subs[id][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[id], ch)
+		if len(h.subs[id]) == 0 {
+			delete(h.subs, id)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) publish(members []string, threshold uint8) {
+	id := hashMembers(slices.Clone(members), threshold)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[id] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func enqueueVaultEvent(txn *badger.Txn, members []string, threshold uint8, typ string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return saveVaultEvent(txn, members, threshold, &VaultEvent{
+		Type:      typ,
+		Data:      b,
+		CreatedAt: time.Now(),
+	}, vaultEventTTL)
+}
+
+// assetsChanged 比较两次同步的余额是否有变化
+func assetsChanged(a, b []*Asset) bool {
+	if len(a) != len(b) {
+		return true
+	}
+
+	m := make(map[string]*Asset, len(a))
+	for _, asset := range a {
+		m[asset.ID] = asset
+	}
+
+	for _, asset := range b {
+		old, ok := m[asset.ID]
+		if !ok ||
+			!old.Balance.Equal(asset.Balance) ||
+			!old.Unspent.Equal(asset.Unspent) ||
+			!old.Signed.Equal(asset.Signed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamVaultEvents 用 Server-Sent Events 推送 vault 的变动，
+// 客户端重连时带上 Last-Event-ID 即可收到断线期间的事件
+func (s *Server) streamVaultEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		renderErr(w, twirp.Internal.Error("streaming unsupported"))
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = p.query.Get("last_event_id")
+	}
+
+	var last uint64
+	if lastID != "" {
+		if last, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			renderErr(w, twirp.InvalidArgumentError("last_event_id", "invalid"))
+			return
+		}
+	} else {
+		txn := s.db.NewTransaction(false)
+		last, err = lastVaultEventID(txn, p.members, p.threshold)
+		txn.Discard()
+
+		if err != nil {
+			renderErr(w, err)
+			return
+		}
+	}
+
+	wake, unsubscribe := s.events.subscribe(p.members, p.threshold)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(vaultEventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		const limit = 100
+
+		txn := s.db.NewTransaction(false)
+		events, err := listVaultEvents(txn, p.members, p.threshold, last, limit)
+		txn.Discard()
+
+		if err != nil {
+			return
+		}
+
+		for _, e := range events {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data); err != nil {
+				return
+			}
+
+			last = e.ID
+		}
+
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+
+		if len(events) == limit {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package cowallet
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
+)
+
+func TestStreamVaultEvents(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		member    = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+		members   = []string{member}
+		threshold = uint8(1)
+	)
+
+	enqueue := func(typ string) {
+		if err := db.Update(func(txn *badger.Txn) error {
+			return enqueueVaultEvent(txn, members, threshold, typ, map[string]string{"type": typ})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enqueue(VaultEventBalanceChanged)
+	enqueue(VaultEventSnapshotCreated)
+
+	s := &Server{db: db, events: newEventHub()}
+
+	m := chi.NewMux()
+	m.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), &User{MixinID: member})))
+		})
+	})
+	m.Get("/vaults/{addr}/events", s.streamVaultEvents)
+
+	svr := httptest.NewServer(m)
+	defer svr.Close()
+
+	addr := mixin.RequireNewMixAddress(members, threshold).String()
+	req, _ := http.NewRequest(http.MethodGet, svr.URL+"/vaults/"+addr+"/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	expect := func(want string) {
+		for {
+			select {
+			case line := <-lines:
+				if line == want {
+					return
+				}
+
+				if strings.HasPrefix(line, "id: ") {
+					t.Fatalf("unexpected event %q, want %q", line, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %q", want)
+			}
+		}
+	}
+
+	// 断线重连只收到 id 之后的事件
+	expect("id: 2")
+	expect("event: " + VaultEventSnapshotCreated)
+
+	enqueue(VaultEventRequestUpdated)
+	s.events.publish(members, threshold)
+	expect("id: 3")
+	expect("event: " + VaultEventRequestUpdated)
+}
+
+func TestAssetsChanged(t *testing.T) {
+	a := []*Asset{{ID: "a"}}
+	if assetsChanged(a, []*Asset{{ID: "a"}}) {
+		t.Error("same assets should not change")
+	}
+
+	b := []*Asset{{ID: "a", Balance: decimal.NewFromInt(1)}}
+	if !assetsChanged(a, b) {
+		t.Error("balance change not detected")
+	}
+
+	if !assetsChanged(a, []*Asset{{ID: "b"}}) {
+		t.Error("asset change not detected")
+	}
+}
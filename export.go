@@ -0,0 +1,303 @@
+package cowallet
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+	"github.com/twitchtv/twirp"
+)
+
+const (
+	ExportFormatCSV   = "csv"
+	ExportFormatJSONL = "jsonl"
+)
+
+type ExportOptions struct {
+	Members   []string
+	Threshold uint8
+	User      uuid.UUID // 地址簿和 vault 备注属于这个用户
+	AssetID   string
+	From      time.Time
+	To        time.Time
+	Format    string
+}
+
+// ExportRow 导出的一行，方便在表格里直接对账
+type ExportRow struct {
+	CreatedAt       time.Time `json:"created_at"`
+	ID              string    `json:"id"`
+	Vault           string    `json:"vault"`
+	VaultName       string    `json:"vault_name"`
+	AssetID         string    `json:"asset_id"`
+	AssetSymbol     string    `json:"asset_symbol"`
+	Direction       string    `json:"direction"`
+	Amount          string    `json:"amount"`
+	Opponent        string    `json:"opponent"`
+	OpponentLabel   string    `json:"opponent_label"`
+	Memo            string    `json:"memo"`
+	TransactionHash string    `json:"transaction_hash"`
+	OutputIndex     uint8     `json:"output_index"`
+	PriceUSD        string    `json:"price_usd"`
+	ValueUSD        string    `json:"value_usd"`
+}
+
+var exportColumns = []string{
+	"created_at",
+	"id",
+	"vault",
+	"vault_name",
+	"asset_id",
+	"asset_symbol",
+	"direction",
+	"amount",
+	"opponent",
+	"opponent_label",
+	"memo",
+	"transaction_hash",
+	"output_index",
+	"price_usd",
+	"value_usd",
+}
+
+func (row *ExportRow) record() []string {
+	return []string{
+		row.CreatedAt.UTC().Format(time.RFC3339),
+		row.ID,
+		row.Vault,
+		row.VaultName,
+		row.AssetID,
+		row.AssetSymbol,
+		row.Direction,
+		row.Amount,
+		row.Opponent,
+		row.OpponentLabel,
+		row.Memo,
+		row.TransactionHash,
+		strconv.Itoa(int(row.OutputIndex)),
+		row.PriceUSD,
+		row.ValueUSD,
+	}
+}
+
+// escapeCSVFormula 防止 memo、备注等用户输入在表格软件里被当成公式执行，
+// 以 = + - @ 或者制表符、回车开头的单元格前面加上 '，负数金额不受影响
+func escapeCSVFormula(v string) string {
+	if v == "" || !strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return v
+	}
+
+	if _, err := decimal.NewFromString(v); err == nil {
+		return v
+	}
+
+	return "'" + v
+}
+
+// exportPageSize 每个只读事务最多读取的 snapshot 数量，写入客户端时不持有事务
+const exportPageSize = 500
+
+// ExportSnapshots 把 vault 的 snapshot 逐行写入 w，symbol 用来查询资产符号
+func ExportSnapshots(db *badger.DB, w io.Writer, opt *ExportOptions, symbol func(assetID string) string) error {
+	if opt.Format != ExportFormatCSV && opt.Format != ExportFormatJSONL {
+		return fmt.Errorf("unsupported format %q", opt.Format)
+	}
+
+	txn := db.NewTransaction(false)
+	vaultName, err := getRemarkName(txn, opt.User, opt.Members, opt.Threshold)
+	if err != nil {
+		txn.Discard()
+		return err
+	}
+
+	addresses, err := listAddress(txn, opt.User)
+	txn.Discard()
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string, len(addresses))
+	for _, a := range addresses {
+		labels[mixin.RequireNewMixAddress(a.Members, a.Threshold).String()] = a.Label
+	}
+
+	var (
+		vault   = mixin.RequireNewMixAddress(opt.Members, opt.Threshold).String()
+		symbols = map[string]string{}
+		cw      = csv.NewWriter(w)
+		enc     = json.NewEncoder(w)
+	)
+
+	if opt.Format == ExportFormatCSV {
+		if err := cw.Write(exportColumns); err != nil {
+			return err
+		}
+	}
+
+	f := &SnapshotFilter{
+		AssetID: opt.AssetID,
+		From:    opt.From,
+		To:      opt.To,
+	}
+
+	prefix, err := f.prefix(opt.Members, opt.Threshold)
+	if err != nil {
+		return err
+	}
+
+	write := func(s *Snapshot) error {
+		sym, ok := symbols[s.AssetID]
+		if !ok {
+			sym = symbol(s.AssetID)
+			symbols[s.AssetID] = sym
+		}
+
+		row := &ExportRow{
+			CreatedAt:       s.CreatedAt,
+			ID:              s.ID.String(),
+			Vault:           vault,
+			VaultName:       vaultName,
+			AssetID:         s.AssetID,
+			AssetSymbol:     sym,
+			Direction:       "in",
+			Amount:          s.Amount.String(),
+			Opponent:        s.Opponent,
+			OpponentLabel:   labels[s.Opponent],
+			Memo:            s.Memo,
+			TransactionHash: s.TransactionHash,
+			OutputIndex:     s.OutputIndex,
+		}
+
+		if s.Amount.IsNegative() {
+			row.Direction = "out"
+		}
+
+		// 入库时的价格，旧的记录没有
+		if s.PriceUSD != nil {
+			row.PriceUSD = s.PriceUSD.String()
+			row.ValueUSD = s.Amount.Mul(*s.PriceUSD).Round(2).String()
+		}
+
+		if opt.Format == ExportFormatJSONL {
+			return enc.Encode(row)
+		}
+
+		record := row.record()
+		for i, v := range record {
+			record[i] = escapeCSVFormula(v)
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+
+		// 边写边发送，不在内存里堆积
+		cw.Flush()
+		return cw.Error()
+	}
+
+	// 分页读取，每页用新的只读事务从上一页最后一个 key 之后继续
+	seek := buildIndexKey(slices.Clone(prefix), max(opt.From.UnixNano(), 0))
+	for {
+		var (
+			page []*Snapshot
+			last []byte
+		)
+
+		txn := db.NewTransaction(false)
+		err := scanSnapshots(txn, prefix, seek, false, f, func(key []byte, s *Snapshot) (bool, error) {
+			page = append(page, s)
+			last = key
+			return len(page) < exportPageSize, nil
+		})
+		txn.Discard()
+
+		if err != nil {
+			return err
+		}
+
+		for _, s := range page {
+			if err := write(s); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < exportPageSize {
+			break
+		}
+
+		seek = append(last, 0)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (s *Server) exportSnapshots(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	p, err := extractVault(r)
+	if err != nil {
+		renderErr(w, err)
+		return
+	}
+
+	opt := &ExportOptions{
+		Members:   p.members,
+		Threshold: p.threshold,
+		User:      uuid.MustParse(p.user.MixinID),
+		AssetID:   p.query.Get("asset"),
+		From:      cast.ToTime(p.query.Get("from")),
+		To:        cast.ToTime(p.query.Get("to")),
+		Format:    p.query.Get("format"),
+	}
+
+	if opt.Format == "" {
+		opt.Format = ExportFormatCSV
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	switch opt.Format {
+	case ExportFormatCSV:
+	case ExportFormatJSONL:
+		contentType = "application/x-ndjson"
+	default:
+		renderErr(w, twirp.InvalidArgumentError("format", "must be csv or jsonl"))
+		return
+	}
+
+	if opt.AssetID != "" {
+		if _, err := uuid.Parse(opt.AssetID); err != nil {
+			renderErr(w, twirp.InvalidArgumentError("asset", "invalid"))
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("%s.%s", mixin.RequireNewMixAddress(p.members, p.threshold).String(), opt.Format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// 已经开始写入之后出错只能记录日志
+	if err := ExportSnapshots(s.db, w, opt, func(assetID string) string {
+		asset, err := s.getSafeAsset(ctx, assetID)
+		if err != nil {
+			return ""
+		}
+
+		return asset.Symbol
+	}); err != nil {
+		slog.Error("ExportSnapshots", "error", err)
+	}
+}
@@ -0,0 +1,186 @@
+package cowallet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestExportSnapshots(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		user      = uuid.MustParse("f25b410b-2ab3-4fb3-bd0f-1d5d280c529d")
+		members   = []string{user.String()}
+		threshold = uint8(1)
+		friend    = []string{"2f7a1a3c-5e5b-4ab2-9b8f-0c9e3f6f1d2a"}
+		assetID   = "965e5c6e-434c-3fa9-b780-c50f43cd955c"
+		now       = time.Now()
+	)
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := saveAddress(txn, Address{UserID: user, Members: friend, Threshold: 1, Label: "Alice"}); err != nil {
+			return err
+		}
+
+		if err := saveRemark(txn, &Remark{User: user, Members: members, Threshold: threshold, Name: "Treasury"}); err != nil {
+			return err
+		}
+
+		for i, amount := range []string{"1.5", "-0.5", "2"} {
+			s := &Snapshot{
+				ID:        uuid.New(),
+				CreatedAt: now.Add(time.Duration(i-3) * time.Hour),
+				AssetID:   assetID,
+				Amount:    decimal.RequireFromString(amount),
+				Memo:      "memo, with comma",
+			}
+
+			if i == 0 {
+				s.Opponent = mixin.RequireNewMixAddress(friend, 1).String()
+			}
+
+			if err := saveSnapshot(txn, s, members, threshold); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	symbol := func(string) string { return "BTC" }
+
+	var buf bytes.Buffer
+	if err := ExportSnapshots(db, &buf, &ExportOptions{
+		Members:   members,
+		Threshold: threshold,
+		User:      user,
+		Format:    ExportFormatCSV,
+	}, symbol); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("want header and 3 rows, got %d", len(records))
+	}
+
+	if row := records[1]; row[3] != "Treasury" || row[5] != "BTC" || row[6] != "in" || row[7] != "1.5" || row[9] != "Alice" || row[10] != "memo, with comma" {
+		t.Errorf("unexpected row %v", row)
+	}
+
+	if row := records[2]; row[6] != "out" || row[7] != "-0.5" {
+		t.Errorf("unexpected row %v", row)
+	}
+
+	// 时间范围是左闭右开
+	buf.Reset()
+	if err := ExportSnapshots(db, &buf, &ExportOptions{
+		Members:   members,
+		Threshold: threshold,
+		User:      user,
+		From:      now.Add(-2 * time.Hour),
+		To:        now.Add(-time.Hour),
+		Format:    ExportFormatJSONL,
+	}, symbol); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want 1 line, got %d", len(lines))
+	}
+
+	var row ExportRow
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+
+	if row.Amount != "-0.5" || row.Direction != "out" {
+		t.Errorf("unexpected row %+v", row)
+	}
+}
+
+func TestExportSnapshotsPaging(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		now       = time.Now()
+		n         = exportPageSize*2 + 1
+	)
+
+	// 同一时间的 snapshot 跨页时不能重复或者遗漏
+	if err := db.Update(func(txn *badger.Txn) error {
+		for i := 0; i < n; i++ {
+			if err := saveSnapshot(txn, &Snapshot{
+				ID:        uuid.New(),
+				CreatedAt: now.Add(time.Duration(i/2) * time.Second),
+				AssetID:   "965e5c6e-434c-3fa9-b780-c50f43cd955c",
+				Amount:    decimal.NewFromInt(1),
+			}, members, threshold); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportSnapshots(db, &buf, &ExportOptions{
+		Members:   members,
+		Threshold: threshold,
+		Format:    ExportFormatJSONL,
+	}, func(string) string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var row ExportRow
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatal(err)
+		}
+
+		ids[row.ID] = true
+	}
+
+	if len(ids) != n {
+		t.Fatalf("want %d rows, got %d", n, len(ids))
+	}
+}
+
+func TestEscapeCSVFormula(t *testing.T) {
+	for v, want := range map[string]string{
+		"":                    "",
+		"hello":               "hello",
+		"-1.5":                "-1.5",
+		"=HYPERLINK(\"x\")":   "'=HYPERLINK(\"x\")",
+		"+cmd":                "'+cmd",
+		"-2+3":                "'-2+3",
+		"@SUM(A1)":            "'@SUM(A1)",
+		"\t=1":                "'\t=1",
+		"MIX3QEeg1WkLrjvjxyw": "MIX3QEeg1WkLrjvjxyw",
+	} {
+		if got := escapeCSVFormula(v); got != want {
+			t.Errorf("%q: want %q, got %q", v, want, got)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package cowallet
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/shopspring/decimal"
+	"github.com/twitchtv/twirp"
+)
+
+const (
+	DefaultCurrency   = "USD"
+	fiatRatesProperty = "fiat_rates"
+)
+
+// FiatRates 每 1 USD 可以兑换的法币数量，由运营者在本地维护
+type FiatRates map[string]decimal.Decimal
+
+type fiatCurrency struct {
+	Code string
+	Rate decimal.Decimal
+}
+
+// displayCurrency 请求没有指定时使用配置的默认法币
+func (s *Server) displayCurrency(code string) (*fiatCurrency, error) {
+	if code == "" {
+		code = s.cfg.Currency
+	}
+
+	code = strings.ToUpper(code)
+	if code == DefaultCurrency {
+		return &fiatCurrency{Code: DefaultCurrency, Rate: decimal.NewFromInt(1)}, nil
+	}
+
+	var rates FiatRates
+	if err := ReadProperty(s.db, fiatRatesProperty, &rates); err != nil {
+		return nil, err
+	}
+
+	rate, ok := rates[code]
+	if !ok || !rate.IsPositive() {
+		return nil, twirp.InvalidArgumentError("currency", "unsupported")
+	}
+
+	return &fiatCurrency{Code: code, Rate: rate}, nil
+}
+
+func (c *fiatCurrency) convert(usd decimal.Decimal) decimal.Decimal {
+	return usd.Mul(c.Rate).Round(2)
+}
+
+// bindVaultAssets 补充资产信息，并按当前价格计算每个资产和 vault 的法币价值
+func (s *Server) bindVaultAssets(ctx context.Context, view *VaultView, fiat *fiatCurrency) {
+	view.Currency = fiat.Code
+	view.ValueUSD = decimal.Zero
+	view.Value = decimal.Zero
+
+	for _, asset := range view.Assets {
+		v, err := s.getSafeAsset(ctx, asset.ID)
+		if err != nil {
+			continue
+		}
+
+		asset.Asset = v
+
+		usd := asset.Balance.Mul(v.PriceUSD).Round(2)
+		value := fiat.convert(usd)
+		asset.ValueUSD = &usd
+		asset.Value = &value
+
+		view.ValueUSD = view.ValueUSD.Add(usd)
+		view.Value = view.Value.Add(value)
+	}
+}
+
+// bindSnapshotValues 按入库时的价格计算 snapshot 的法币价值，没有价格的留空
+func bindSnapshotValues(snapshots []*Snapshot, fiat *fiatCurrency) {
+	for _, s := range snapshots {
+		if s.PriceUSD == nil {
+			continue
+		}
+
+		value := fiat.convert(s.Amount.Mul(*s.PriceUSD))
+		s.Value = &value
+		s.Currency = fiat.Code
+	}
+}
+
+// snapshotPrices 查询 snapshot 涉及的资产价格，在写事务之前调用，查询失败的资产不记录价格
+func snapshotPrices(ctx context.Context, getAsset func(ctx context.Context, id string) (*mixin.SafeAsset, error), snapshots []*Snapshot) map[string]decimal.Decimal {
+	prices := make(map[string]decimal.Decimal)
+	if getAsset == nil {
+		return prices
+	}
+
+	for _, s := range snapshots {
+		if _, ok := prices[s.AssetID]; ok {
+			continue
+		}
+
+		asset, err := getAsset(ctx, s.AssetID)
+		if err != nil {
+			continue
+		}
+
+		prices[s.AssetID] = asset.PriceUSD
+	}
+
+	return prices
+}
@@ -0,0 +1,89 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/shopspring/decimal"
+	"github.com/yiplee/go-cache"
+)
+
+func TestBindVaultAssets(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := SaveProperty(db, fiatRatesProperty, FiatRates{"CNY": decimal.NewFromFloat(7.2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		db:     db,
+		cfg:    Config{Currency: DefaultCurrency},
+		assets: cache.New[string, *mixin.SafeAsset](),
+	}
+
+	s.assets.Set("btc", &mixin.SafeAsset{PriceUSD: decimal.NewFromInt(60000)})
+	s.assets.Set("usdt", &mixin.SafeAsset{PriceUSD: decimal.NewFromInt(1)})
+
+	if _, err := s.displayCurrency("EUR"); err == nil {
+		t.Fatal("unsupported currency should fail")
+	}
+
+	fiat, err := s.displayCurrency("cny")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	view := &VaultView{
+		Vault: &Vault{
+			Assets: []*Asset{
+				{ID: "btc", Balance: decimal.NewFromFloat(0.5)},
+				{ID: "usdt", Balance: decimal.NewFromInt(100)},
+			},
+		},
+	}
+
+	s.bindVaultAssets(context.Background(), view, fiat)
+
+	if view.Currency != "CNY" || !view.ValueUSD.Equal(decimal.NewFromInt(30100)) || !view.Value.Equal(decimal.NewFromInt(216720)) {
+		t.Fatalf("unexpected view value %s USD, %s %s", view.ValueUSD, view.Value, view.Currency)
+	}
+
+	if v := view.Assets[1].Value; v == nil || !v.Equal(decimal.NewFromInt(720)) {
+		t.Fatalf("unexpected asset value %v", v)
+	}
+}
+
+func TestBindSnapshotValues(t *testing.T) {
+	price := decimal.NewFromInt(60000)
+	snapshots := []*Snapshot{
+		{AssetID: "btc", Amount: decimal.NewFromFloat(-0.5), PriceUSD: &price},
+		{AssetID: "usdt", Amount: decimal.NewFromInt(100)},
+	}
+
+	bindSnapshotValues(snapshots, &fiatCurrency{Code: "CNY", Rate: decimal.NewFromFloat(7.2)})
+
+	if v := snapshots[0].Value; v == nil || !v.Equal(decimal.NewFromInt(-216000)) || snapshots[0].Currency != "CNY" {
+		t.Fatalf("unexpected snapshot value %v %s", v, snapshots[0].Currency)
+	}
+
+	if snapshots[1].Value != nil {
+		t.Fatal("snapshot without price should have no value")
+	}
+}
+
+func TestSnapshotPrices(t *testing.T) {
+	getAsset := func(ctx context.Context, id string) (*mixin.SafeAsset, error) {
+		if id == "btc" {
+			return &mixin.SafeAsset{PriceUSD: decimal.NewFromInt(60000)}, nil
+		}
+
+		return nil, errors.New("not found")
+	}
+
+	prices := snapshotPrices(context.Background(), getAsset, []*Snapshot{{AssetID: "btc"}, {AssetID: "usdt"}, {AssetID: "btc"}})
+	if len(prices) != 1 || !prices["btc"].Equal(decimal.NewFromInt(60000)) {
+		t.Fatalf("unexpected prices %v", prices)
+	}
+}
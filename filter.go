@@ -0,0 +1,291 @@
+package cowallet
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+	"github.com/twitchtv/twirp"
+)
+
+const (
+	SnapshotDirectionIn  = "in"
+	SnapshotDirectionOut = "out"
+)
+
+// SnapshotFilter 查询 snapshot 的条件，金额范围比较的是绝对值，时间范围左闭右开
+type SnapshotFilter struct {
+	AssetID         string
+	Direction       string
+	Opponent        string
+	MinAmount       *decimal.Decimal
+	MaxAmount       *decimal.Decimal
+	Memo            string
+	TransactionHash string
+	From            time.Time
+	To              time.Time
+}
+
+func parseSnapshotFilter(q url.Values) (*SnapshotFilter, error) {
+	f := &SnapshotFilter{
+		AssetID:         q.Get("asset"),
+		Direction:       q.Get("flow"),
+		Memo:            q.Get("memo"),
+		TransactionHash: q.Get("tx_hash"),
+		From:            cast.ToTime(q.Get("from")),
+		To:              cast.ToTime(q.Get("to")),
+	}
+
+	if f.AssetID != "" {
+		if _, err := uuid.Parse(f.AssetID); err != nil {
+			return nil, twirp.InvalidArgumentError("asset", "invalid")
+		}
+	}
+
+	if f.Direction != "" && f.Direction != SnapshotDirectionIn && f.Direction != SnapshotDirectionOut {
+		return nil, twirp.InvalidArgumentError("flow", "must be in or out")
+	}
+
+	if v := q.Get("opponent"); v != "" {
+		addr, err := mixin.MixAddressFromString(v)
+		if err != nil {
+			return nil, twirp.InvalidArgumentError("opponent", "invalid")
+		}
+
+		f.Opponent = addr.String()
+	}
+
+	for name, dst := range map[string]**decimal.Decimal{
+		"min_amount": &f.MinAmount,
+		"max_amount": &f.MaxAmount,
+	} {
+		if v := q.Get(name); v != "" {
+			d, err := decimal.NewFromString(v)
+			if err != nil {
+				return nil, twirp.InvalidArgumentError(name, "invalid")
+			}
+
+			*dst = &d
+		}
+	}
+
+	return f, nil
+}
+
+// prefix 选择最合适的索引，交易哈希、对方地址和方向有单独的索引，其他条件在遍历时过滤
+func (f *SnapshotFilter) prefix(members []string, threshold uint8) ([]byte, error) {
+	switch {
+	case f.TransactionHash != "":
+		return buildIndexKey(snapshotTxIndexPrefix, hashMembers(members, threshold), f.TransactionHash), nil
+	case f.Opponent != "":
+		return buildIndexKey(snapshotOpponentIndexPrefix, hashMembers(members, threshold), f.Opponent), nil
+	case f.AssetID == "" && f.Direction != "":
+		return buildIndexKey(snapshotDirectionIndexPrefix, hashMembers(members, threshold), f.Direction), nil
+	}
+
+	return snapshotIndexPrefix(members, threshold, f.AssetID)
+}
+
+// indexOnly 除了时间范围以外的条件都可以由 prefix 选择的索引满足，不需要读取 snapshot
+func (f *SnapshotFilter) indexOnly() bool {
+	rest := *f
+	rest.From, rest.To = time.Time{}, time.Time{}
+
+	switch {
+	case f.TransactionHash != "":
+		rest.TransactionHash = ""
+	case f.Opponent != "":
+		rest.Opponent = ""
+	case f.AssetID != "":
+		rest.AssetID = ""
+	default:
+		rest.Direction = ""
+	}
+
+	return rest == SnapshotFilter{}
+}
+
+// snapshotDirection 金额为 0 的 snapshot 没有方向
+func snapshotDirection(s *Snapshot) string {
+	switch {
+	case s.Amount.IsPositive():
+		return SnapshotDirectionIn
+	case s.Amount.IsNegative():
+		return SnapshotDirectionOut
+	}
+
+	return ""
+}
+
+func (f *SnapshotFilter) match(s *Snapshot) bool {
+	if f.AssetID != "" && s.AssetID != f.AssetID {
+		return false
+	}
+
+	if f.Direction != "" && snapshotDirection(s) != f.Direction {
+		return false
+	}
+
+	if f.Opponent != "" && s.Opponent != f.Opponent {
+		return false
+	}
+
+	if f.TransactionHash != "" && s.TransactionHash != f.TransactionHash {
+		return false
+	}
+
+	if amount := s.Amount.Abs(); (f.MinAmount != nil && amount.LessThan(*f.MinAmount)) ||
+		(f.MaxAmount != nil && amount.GreaterThan(*f.MaxAmount)) {
+		return false
+	}
+
+	if f.Memo != "" && !strings.Contains(strings.ToLower(s.Memo), strings.ToLower(f.Memo)) {
+		return false
+	}
+
+	return true
+}
+
+// scanSnapshots 从 seek 开始按方向遍历索引，fn 返回 false 时停止
+func scanSnapshots(txn *badger.Txn, prefix, seek []byte, reverse bool, f *SnapshotFilter, fn func(key []byte, s *Snapshot) (bool, error)) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = reverse
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var (
+		from = f.From.UnixNano()
+		to   = f.To.UnixNano()
+	)
+
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().KeyCopy(nil)
+
+		var (
+			ts int64
+			id uuid.UUID
+		)
+
+		if err := decodeIndexKey(key, prefix, &ts, &id); err != nil {
+			return err
+		}
+
+		if !f.From.IsZero() && ts < from {
+			if reverse {
+				break
+			}
+
+			continue
+		}
+
+		if !f.To.IsZero() && ts >= to {
+			if reverse {
+				continue
+			}
+
+			break
+		}
+
+		s, err := findSnapshot(txn, id)
+		if err != nil {
+			return err
+		}
+
+		if !f.match(s) {
+			continue
+		}
+
+		if ok, err := fn(key, s); err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotFilterIndexKeys 对方地址、交易哈希和方向的索引
+func snapshotFilterIndexKeys(vault uuid.UUID, s *Snapshot) [][]byte {
+	var keys [][]byte
+	if d := snapshotDirection(s); d != "" {
+		keys = append(keys, buildIndexKey(snapshotDirectionIndexPrefix, vault, d, s.CreatedAt.UnixNano(), s.ID))
+	}
+
+	if s.Opponent != "" {
+		keys = append(keys, buildIndexKey(snapshotOpponentIndexPrefix, vault, s.Opponent, s.CreatedAt.UnixNano(), s.ID))
+	}
+
+	if s.TransactionHash != "" {
+		keys = append(keys, buildIndexKey(snapshotTxIndexPrefix, vault, s.TransactionHash, s.CreatedAt.UnixNano(), s.ID))
+	}
+
+	return keys
+}
+
+// indexSnapshots 为已有的 snapshot 补上对方地址、交易哈希和方向索引，重复执行只会覆盖相同的索引，
+// 返回写入的索引数量
+func indexSnapshots(ctx context.Context, db *badger.DB, dryRun bool) (int, error) {
+	slog.Info("index snapshots", "dry_run", dryRun)
+
+	var n int
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	if err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(snapshotVaultIndexPrefix); it.ValidForPrefix(snapshotVaultIndexPrefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var (
+				vault uuid.UUID
+				ts    int64
+				id    uuid.UUID
+			)
+
+			if err := decodeIndexKey(it.Item().Key(), snapshotVaultIndexPrefix, &vault, &ts, &id); err != nil {
+				return err
+			}
+
+			s, err := findSnapshot(txn, id)
+			if err != nil {
+				return err
+			}
+
+			for _, key := range snapshotFilterIndexKeys(vault, s) {
+				n++
+				if dryRun {
+					continue
+				}
+
+				if err := wb.Set(key, nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return n, nil
+	}
+
+	return n, wb.Flush()
+}
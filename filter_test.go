@@ -0,0 +1,169 @@
+package cowallet
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestSnapshotFilter(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		alice     = mixin.RequireNewMixAddress([]string{"2f7a1a3c-5e5b-4ab2-9b8f-0c9e3f6f1d2a"}, 1).String()
+		now       = time.Now()
+	)
+
+	snapshots := []*Snapshot{
+		{Amount: decimal.NewFromInt(5), Opponent: alice, Memo: "Salary March", TransactionHash: "a1"},
+		{Amount: decimal.NewFromInt(-2), Memo: "rent", TransactionHash: "b2"},
+		{Amount: decimal.NewFromInt(20), Opponent: alice, Memo: "bonus", TransactionHash: "c3"},
+		{Amount: decimal.NewFromInt(1), Memo: "salary april", TransactionHash: "d4"},
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		for i, s := range snapshots {
+			s.ID = uuid.New()
+			s.CreatedAt = now.Add(time.Duration(i-len(snapshots)) * time.Hour)
+			s.AssetID = "965e5c6e-434c-3fa9-b780-c50f43cd955c"
+			if err := saveSnapshot(txn, s, members, threshold); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(q url.Values) []*Snapshot {
+		f, err := parseSnapshotFilter(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		result, err := listSnapshots(txn, members, threshold, f, time.Time{}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return result
+	}
+
+	for _, c := range []struct {
+		query url.Values
+		want  []*Snapshot
+	}{
+		{url.Values{"flow": {"out"}}, []*Snapshot{snapshots[1]}},
+		{url.Values{"opponent": {alice}}, []*Snapshot{snapshots[2], snapshots[0]}},
+		{url.Values{"opponent": {alice}, "min_amount": {"10"}}, []*Snapshot{snapshots[2]}},
+		{url.Values{"max_amount": {"2"}}, []*Snapshot{snapshots[3], snapshots[1]}},
+		{url.Values{"memo": {"SALARY"}}, []*Snapshot{snapshots[3], snapshots[0]}},
+		{url.Values{"tx_hash": {"b2"}}, []*Snapshot{snapshots[1]}},
+		{url.Values{"from": {snapshots[1].CreatedAt.Format(time.RFC3339Nano)}, "to": {snapshots[3].CreatedAt.Format(time.RFC3339Nano)}}, []*Snapshot{snapshots[2], snapshots[1]}},
+	} {
+		got := list(c.query)
+		if len(got) != len(c.want) {
+			t.Errorf("%v: want %d snapshots, got %d", c.query, len(c.want), len(got))
+			continue
+		}
+
+		for i := range got {
+			if got[i].ID != c.want[i].ID {
+				t.Errorf("%v: unexpected snapshot at %d", c.query, i)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		query     url.Values
+		indexOnly bool
+		want      int
+	}{
+		{url.Values{"flow": {"in"}}, true, 3},
+		{url.Values{"flow": {"out"}, "from": {snapshots[1].CreatedAt.Format(time.RFC3339Nano)}}, true, 1},
+		{url.Values{"tx_hash": {"c3"}}, true, 1},
+		{url.Values{"memo": {"salary"}}, false, 2},
+		{url.Values{"flow": {"in"}, "opponent": {alice}}, false, 2},
+	} {
+		f, err := parseSnapshotFilter(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.indexOnly() != c.indexOnly {
+			t.Errorf("%v: want index only %v", c.query, c.indexOnly)
+		}
+
+		txn := db.NewTransaction(false)
+		n, capped, err := countSnapshots(txn, members, threshold, f)
+		txn.Discard()
+
+		if err != nil || capped || n != c.want {
+			t.Errorf("%v: want count %d, got %d %v %v", c.query, c.want, n, capped, err)
+		}
+	}
+
+	// 删除对方地址索引之后可以重新建立
+	if err := db.Update(func(txn *badger.Txn) error {
+		for _, s := range snapshots {
+			for _, key := range snapshotFilterIndexKeys(hashMembers(members, threshold), s) {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := list(url.Values{"opponent": {alice}}); len(got) != 0 {
+		t.Fatalf("want no snapshots before indexing, got %d", len(got))
+	}
+
+	if _, err := indexSnapshots(context.Background(), db, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := list(url.Values{"opponent": {alice}}); len(got) != 2 {
+		t.Fatalf("want 2 snapshots after indexing, got %d", len(got))
+	}
+}
+
+func TestRequestToSnapshot(t *testing.T) {
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d", "8017d200-7870-4b82-b53f-74bae1d2dad7"}
+		threshold = uint8(1)
+		bob       = []string{"2f7a1a3c-5e5b-4ab2-9b8f-0c9e3f6f1d2a"}
+	)
+
+	s := requestToSnapshot(&mixin.SafeMultisigRequest{
+		RequestID: uuid.NewString(),
+		Amount:    decimal.NewFromInt(3),
+		Receivers: []*mixin.SafeMultisigReceiver{
+			{Members: members, Threshold: threshold},
+			{Members: bob, Threshold: 1},
+		},
+	}, members, threshold)
+
+	if want := mixin.RequireNewMixAddress(bob, 1).String(); s.Opponent != want {
+		t.Fatalf("want opponent %s, got %s", want, s.Opponent)
+	}
+
+	if !s.Amount.Equal(decimal.NewFromInt(-3)) {
+		t.Fatalf("unexpected amount %s", s.Amount)
+	}
+}
@@ -0,0 +1,83 @@
+package cowallet
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+const invoiceTTL = time.Hour
+
+func newInvoice(clientID string, addr *mixin.MixAddress, plan *Plan) *Invoice {
+	now := time.Now()
+	v := &Invoice{
+		ID:        uuid.New(),
+		Members:   addr.Members(),
+		Threshold: addr.Threshold,
+		Plan:      plan.ID,
+		Asset:     plan.AssetID,
+		Amount:    plan.Amount,
+		Period:    planPeriod(plan, plan.Amount),
+		Memo:      addr.String(),
+		State:     InvoiceStatePending,
+		CreatedAt: now,
+		ExpiredAt: now.Add(invoiceTTL),
+	}
+
+	q := url.Values{}
+	q.Set("asset", v.Asset)
+	q.Set("amount", v.Amount.String())
+	q.Set("memo", v.Memo)
+	q.Set("trace", v.ID.String())
+	v.PayURL = fmt.Sprintf("https://mixin.one/pay/%s?%s", clientID, q.Encode())
+
+	return v
+}
+
+func invoiceState(v *Invoice, now time.Time) string {
+	if v.State == InvoiceStatePending && now.After(v.ExpiredAt) {
+		return InvoiceStateExpired
+	}
+
+	return v.State
+}
+
+// markInvoicePaid 续费的 request id 即为支付时使用的 trace id，
+// 只有在过期之前付给同一个 vault、资产一致并且金额不少于账单金额的续费才算支付了账单，
+// 过期之后的付款仍然按套餐正常续费，账单保持过期
+func markInvoicePaid(txn *badger.Txn, r *Renew) error {
+	v, err := findInvoice(txn, r.ID)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	if v.State == InvoiceStatePaid {
+		return nil
+	}
+
+	if hashMembers(v.Members, v.Threshold) != hashMembers(r.Members, r.Threshold) {
+		return nil
+	}
+
+	if v.Asset != r.Asset || r.Amount.LessThan(v.Amount) {
+		return nil
+	}
+
+	if r.CreatedAt.After(v.ExpiredAt) {
+		return nil
+	}
+
+	v.State = InvoiceStatePaid
+	v.Renew = &r.ID
+	v.PaidAt = &r.CreatedAt
+	return saveInvoice(txn, v)
+}
@@ -0,0 +1,114 @@
+package cowallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestMarkInvoicePaid(t *testing.T) {
+	const (
+		usdt  = "4d8c508b-91c5-375b-92b0-ee702ed2dac5"
+		btc   = "c6d0c728-2624-429b-8e0d-d9d19b6592fa"
+		alice = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+		bob   = "8017d200-7870-4b82-b53f-74bae1d2dad7"
+	)
+
+	members := []string{alice, bob}
+
+	cases := []struct {
+		name    string
+		members []string
+		asset   string
+		amount  int64
+		late    bool
+		paid    bool
+	}{
+		{"paid", members, usdt, 10, false, true},
+		{"overpaid", members, usdt, 20, false, true},
+		{"other vault", []string{alice}, usdt, 10, false, false},
+		{"other asset", members, btc, 10, false, false},
+		{"amount too small", members, usdt, 5, false, false},
+		{"expired", members, usdt, 10, true, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newTestDB(t)
+
+			now := time.Now()
+			v := &Invoice{
+				ID:        uuid.New(),
+				Members:   members,
+				Threshold: 1,
+				Plan:      "monthly",
+				Asset:     usdt,
+				Amount:    decimal.NewFromInt(10),
+				State:     InvoiceStatePending,
+				CreatedAt: now,
+				ExpiredAt: now.Add(invoiceTTL),
+			}
+
+			paidAt := now
+			if c.late {
+				paidAt = v.ExpiredAt.Add(time.Second)
+			}
+
+			r := &Renew{
+				ID:        v.ID,
+				CreatedAt: paidAt,
+				Members:   c.members,
+				Threshold: 1,
+				Asset:     c.asset,
+				Amount:    decimal.NewFromInt(c.amount),
+			}
+
+			if err := db.Update(func(txn *badger.Txn) error {
+				if err := saveInvoice(txn, v); err != nil {
+					return err
+				}
+
+				return markInvoicePaid(txn, r)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.View(func(txn *badger.Txn) error {
+				var err error
+				v, err = findInvoice(txn, v.ID)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if paid := v.State == InvoiceStatePaid; paid != c.paid {
+				t.Fatalf("want paid %v, got state %s", c.paid, v.State)
+			}
+
+			if c.paid && (v.Renew == nil || *v.Renew != r.ID) {
+				t.Fatalf("renew not recorded")
+			}
+		})
+	}
+}
+
+func TestInvoiceState(t *testing.T) {
+	now := time.Now()
+	v := &Invoice{State: InvoiceStatePending, ExpiredAt: now.Add(invoiceTTL)}
+
+	if s := invoiceState(v, now); s != InvoiceStatePending {
+		t.Fatalf("want pending, got %s", s)
+	}
+
+	if s := invoiceState(v, now.Add(2*invoiceTTL)); s != InvoiceStateExpired {
+		t.Fatalf("want expired, got %s", s)
+	}
+
+	v.State = InvoiceStatePaid
+	if s := invoiceState(v, now.Add(2*invoiceTTL)); s != InvoiceStatePaid {
+		t.Fatalf("want paid, got %s", s)
+	}
+}
@@ -3,6 +3,8 @@ package cowallet
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"time"
 
@@ -22,6 +24,73 @@ type Job struct {
 	Threshold uint8     `json:"threshold"`
 }
 
+// scrubJobTokens 旧版本会把用户的 keystore 直接写进同步任务，重新保存去掉 token，保留任务原来的过期时间
+func scrubJobTokens(ctx context.Context, db *badger.DB, dryRun bool) (int, error) {
+	slog.Info("scrub job tokens", "dry_run", dryRun)
+
+	var n int
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	if err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(jobPrefix); it.ValidForPrefix(jobPrefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var legacy struct {
+				User *struct {
+					Token string `json:"token"`
+				} `json:"user"`
+			}
+
+			var job Job
+			if err := it.Item().Value(func(b []byte) error {
+				if err := json.Unmarshal(b, &legacy); err != nil {
+					return err
+				}
+
+				return json.Unmarshal(b, &job)
+			}); err != nil {
+				return err
+			}
+
+			if legacy.User == nil || legacy.User.Token == "" {
+				continue
+			}
+
+			n++
+			if dryRun {
+				continue
+			}
+
+			b, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+
+			e := badger.NewEntry(it.Item().KeyCopy(nil), b)
+			e.ExpiresAt = it.Item().ExpiresAt()
+			if err := wb.SetEntry(e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return n, nil
+	}
+
+	return n, wb.Flush()
+}
+
 func (s *Server) HandlePendingJobs(ctx context.Context) error {
 	for {
 		_ = s.handlePendingJobs(ctx)
@@ -41,22 +110,86 @@ func (s *Server) handlePendingJobs(ctx context.Context) error {
 		return err
 	}
 
+	pendingJobs.Set(float64(len(jobs)))
+
 	var g errgroup.Group
-	g.SetLimit(10)
+	g.SetLimit(s.cfg.SyncConcurrency)
 
 	for idx := range jobs {
 		job := jobs[idx]
+
+		if job.User == nil {
+			g.Go(func() error {
+				_, err := handleJob(ctx, s.db, nil, nil, job)
+				return err
+			})
+
+			continue
+		}
+
+		schedule, err := FindSchedule(s.db, job.Members, job.Threshold)
+		if err != nil {
+			slog.Error("FindSchedule", "error", err)
+			return err
+		}
+
+		if time.Now().Before(schedule.NextRunAt) {
+			continue
+		}
+
 		g.Go(func() error {
-			return handleJob(ctx, s.db, job)
+			return s.runJob(ctx, job, schedule)
 		})
 	}
 
 	return g.Wait()
 }
 
-func handleJob(ctx context.Context, db *badger.DB, job *Job) error {
+func (s *Server) runJob(ctx context.Context, job *Job, schedule *Schedule) error {
+	start := time.Now()
+
+	var (
+		client *mixin.Client
+		err    error
+	)
+
+	if job.User != nil {
+		client, err = s.userClient(job.User)
+		observeSync("credential", start, err)
+		if err != nil {
+			slog.Error("userClient", "error", err)
+		}
+	}
+
+	// 没有可用的 access token 时同步会一直失败，在 schedule 里标记出来
+	schedule.CredentialMissing = errors.Is(err, errNoCredential) || errors.Is(err, errCredentialExpired)
+
+	var active bool
+	if err == nil {
+		active, err = handleJob(ctx, s.db, client, s.getSafeAsset, job)
+		observeSync("total", start, err)
+	}
+
+	if err == nil {
+		s.events.publish(job.Members, job.Threshold)
+	}
+
+	scheduleNextRun(schedule, time.Now(), active, err)
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return saveSchedule(txn, schedule)
+	}); err != nil {
+		slog.Error("saveSchedule", "error", err)
+		return err
+	}
+
+	return err
+}
+
+// handleJob 同步 vault 的 utxo，返回 vault 是否活跃（有新的 utxo 或者未完成的多签请求），
+// getAsset 用来记录新 snapshot 的价格
+func handleJob(ctx context.Context, db *badger.DB, client *mixin.Client, getAsset func(ctx context.Context, id string) (*mixin.SafeAsset, error), job *Job) (_ bool, err error) {
 	if job.User == nil {
-		return db.Update(func(txn *badger.Txn) error {
+		return false, db.Update(func(txn *badger.Txn) error {
 			return saveVaultIfNotExist(txn, &Vault{
 				Members:   job.Members,
 				Threshold: job.Threshold,
@@ -66,31 +199,41 @@ func handleJob(ctx context.Context, db *badger.DB, job *Job) error {
 
 	slog.Info("handle job", "user", job.User.MixinID, "members", job.Members, "threshold", job.Threshold)
 
-	client, err := clientFromToken(job.User.Token)
+	vault, err := FindVault(db, job.Members, job.Threshold)
 	if err != nil {
-		slog.Error("clientFromToken", "error", err)
-		return err
+		slog.Error("find vault", "error", err)
+		return false, err
 	}
 
-	vault, err := FindVault(db, job.Members, job.Threshold)
+	// 第一次同步拉到的是全部历史记录，不发送通知、webhook 和 snapshot / 多签请求事件
+	initial := vault.Offset == 0
+
+	// utxo 状态变化时 sequence 会更新，所以只需要从上次的位置往后同步；
+	// 定期从本地最早的 utxo 开始对账，sequence 没有更新的状态变化也不会一直漏掉
+	txn := db.NewTransaction(false)
+	start, reconcile, err := syncOffset(txn, vault, time.Now())
+	txn.Discard()
 	if err != nil {
-		slog.Error("find vault", "error", err)
-		return err
+		slog.Error("syncOffset", "error", err)
+		return false, err
 	}
 
 	var (
-		a, b            uint64
-		offset          = vault.Offset
-		assets          = map[string]*Asset{}
+		offset          = start
+		outputs         []*mixin.SafeUtxo
 		snapshots       []*Snapshot
+		requests        []*MultisigRequest
 		handledSignedBy = mapset.New[string]()
 	)
 
 	addr := mixin.RequireNewMixAddress(job.Members, job.Threshold).String()
 
+	stage := newSyncStage("utxos")
+	defer func() { stage.done(err) }()
+
 	for {
 		const limit = 500
-		outputs, err := client.SafeListUtxos(ctx, mixin.SafeListUtxoOption{
+		page, err := client.SafeListUtxos(ctx, mixin.SafeListUtxoOption{
 			Members:   vault.Members,
 			Threshold: vault.Threshold,
 			Offset:    offset,
@@ -99,11 +242,12 @@ func handleJob(ctx context.Context, db *badger.DB, job *Job) error {
 
 		if err != nil {
 			slog.Error("SafeListUtxos", "error", err)
-			return err
+			return false, err
 		}
 
-		for _, output := range outputs {
+		for _, output := range page {
 			offset = output.Sequence + 1
+			outputs = append(outputs, output)
 
 			// 收款
 			if ok := output.OutputIndex > 0 &&
@@ -112,99 +256,268 @@ func handleJob(ctx context.Context, db *badger.DB, job *Job) error {
 				snapshots = append(snapshots, outputToSnapshot(output))
 			}
 
-			if output.State == mixin.SafeUtxoStateSpent {
-				if !handledSignedBy.Has(output.SignedBy) {
-					req, err := client.SafeReadMultisigRequests(ctx, output.SignedBy)
-					if err != nil {
-						slog.Error("SafeReadMultisigRequests", "error", err)
-						return err
-					}
-
-					if req.Amount.IsZero() {
-						h, _ := mixinnet.HashFromString(req.TransactionHash)
-						utxo, err := client.SafeReadUtxoByHash(ctx, h, 0)
-						if err != nil {
-							slog.Error("SafeReadUtxoByHash", "error", err)
-							return err
-						}
+			if output.State == mixin.SafeUtxoStateSpent && !handledSignedBy.Has(output.SignedBy) {
+				req, err := client.SafeReadMultisigRequests(ctx, output.SignedBy)
+				if err != nil {
+					slog.Error("SafeReadMultisigRequests", "error", err)
+					return false, err
+				}
 
-						req.Amount = utxo.Amount
+				if req.Amount.IsZero() {
+					h, _ := mixinnet.HashFromString(req.TransactionHash)
+					utxo, err := client.SafeReadUtxoByHash(ctx, h, 0)
+					if err != nil {
+						slog.Error("SafeReadUtxoByHash", "error", err)
+						return false, err
 					}
 
-					snapshots = append(snapshots, requestToSnapshot(req))
-					handledSignedBy.Put(output.SignedBy)
+					req.Amount = utxo.Amount
 				}
 
-				a = output.Sequence + 1
-				continue
+				snapshots = append(snapshots, requestToSnapshot(req, vault.Members, vault.Threshold))
+				requests = append(requests, requestToMultisigRequest(req, vault.Members, vault.Threshold, MultisigRequestStateSpent))
+				handledSignedBy.Put(output.SignedBy)
 			}
+		}
 
-			asset, ok := assets[output.AssetID]
-			if !ok {
-				asset = &Asset{
-					ID:   output.AssetID,
-					Hash: output.KernelAssetID.String(),
-				}
+		if len(page) < limit {
+			break
+		}
+	}
 
-				assets[output.AssetID] = asset
-			}
+	// 价格在写事务之前查询，避免事务因为网络请求而变长
+	prices := snapshotPrices(ctx, getAsset, snapshots)
 
-			asset.Balance = asset.Balance.Add(output.Amount)
-			if output.State == mixin.SafeUtxoStateUnspent {
-				asset.Unspent = asset.Unspent.Add(output.Amount)
-			} else if output.State == mixin.SafeUtxoStateSigned {
-				asset.Signed = asset.Signed.Add(output.Amount)
-				if !govalidator.IsIn(output.SignedBy, asset.Requests...) {
-					asset.Requests = append(asset.Requests, output.SignedBy)
-				}
+	txn = db.NewTransaction(true)
+	defer txn.Discard()
+
+	for _, output := range outputs {
+		if err := applyUtxo(txn, vault.Members, vault.Threshold, output); err != nil {
+			slog.Error("applyUtxo", "error", err)
+			return false, err
+		}
+	}
+
+	assets, err := listVaultAssets(txn, vault.Members, vault.Threshold)
+	if err != nil {
+		slog.Error("listVaultAssets", "error", err)
+		return false, err
+	}
+
+	active := offset > vault.Offset
+	for _, asset := range assets {
+		if len(asset.Requests) > 0 {
+			active = true
+		}
+	}
+
+	if !reconcile && offset <= vault.Offset && time.Since(vault.UpdatedAt) < time.Minute {
+		return active, nil
+	}
+
+	balanceChanged := assetsChanged(vault.Assets, assets)
+	newDay := checkpointDate(vault.UpdatedAt) != checkpointDate(time.Now())
+	vault.Assets = assets
+	vault.Offset = max(offset, vault.Offset)
+	vault.UpdatedAt = time.Now()
+	if reconcile {
+		vault.ReconciledAt = vault.UpdatedAt
+	}
+
+	// 刷新还在等待签名的多签请求
+	stage.next("requests")
+	for _, asset := range vault.Assets {
+		for _, id := range asset.Requests {
+			req, err := client.SafeReadMultisigRequests(ctx, id)
+			if err != nil {
+				slog.Error("SafeReadMultisigRequests", "error", err)
+				return false, err
 			}
 
-			if b == 0 {
-				b = output.Sequence
+			state := MultisigRequestStateInitial
+			if len(req.Signers) >= int(vault.Threshold) {
+				state = MultisigRequestStateSigned
 			}
+
+			requests = append(requests, requestToMultisigRequest(req, vault.Members, vault.Threshold, state))
+			handledSignedBy.Put(id)
 		}
+	}
 
-		if len(outputs) == 0 {
-			break
+	stage.next("commit")
+	if balanceChanged || newDay {
+		if err := saveVaultCheckpoints(txn, vault); err != nil {
+			slog.Error("saveVaultCheckpoints", "error", err)
+			return false, err
 		}
 	}
 
-	if offset <= vault.Offset && time.Since(vault.UpdatedAt) < time.Minute {
-		return nil
+	if balanceChanged {
+		if err := enqueueVaultEvent(txn, vault.Members, vault.Threshold, VaultEventBalanceChanged, vault.Assets); err != nil {
+			slog.Error("enqueueVaultEvent", "error", err)
+			return false, err
+		}
 	}
 
-	vault.Assets = vault.Assets[0:0]
-	for _, asset := range assets {
-		vault.Assets = append(vault.Assets, asset)
+	for _, r := range requests {
+		if err := applyMultisigRequest(txn, r, initial); err != nil {
+			slog.Error("applyMultisigRequest", "error", err)
+			return false, err
+		}
 	}
 
-	vault.Offset = max(getNewOffset(a, b), vault.Offset)
-	vault.UpdatedAt = time.Now()
+	// 之前未完成的请求如果没有再锁定任何 utxo，也没有被花费，说明已经被解锁
+	openRequests, err := listOpenMultisigRequests(txn, vault.Members, vault.Threshold)
+	if err != nil {
+		slog.Error("listOpenMultisigRequests", "error", err)
+		return false, err
+	}
 
-	txn := db.NewTransaction(true)
-	defer txn.Discard()
+	for _, r := range openRequests {
+		if handledSignedBy.Has(r.ID.String()) {
+			continue
+		}
+
+		// 还没有人签名的请求不会锁定 utxo，需要单独查询签名状态
+		if len(r.Signers) == 0 {
+			req, err := client.SafeReadMultisigRequests(ctx, r.ID.String())
+			if err != nil {
+				slog.Error("SafeReadMultisigRequests", "error", err)
+				return false, err
+			}
+
+			if len(req.Signers) == 0 {
+				continue
+			}
+		}
+
+		r.State = MultisigRequestStateUnlocked
+		r.UpdatedAt = time.Now()
+		if err := saveMultisigRequest(txn, r); err != nil {
+			slog.Error("saveMultisigRequest", "error", err)
+			return false, err
+		}
+
+		if initial {
+			continue
+		}
+
+		if err := enqueueVaultEvent(txn, vault.Members, vault.Threshold, VaultEventRequestUpdated, r); err != nil {
+			slog.Error("enqueueVaultEvent", "error", err)
+			return false, err
+		}
+	}
 
 	for _, s := range snapshots {
+		old, err := findSnapshot(txn, s.ID)
+		isNew := errors.Is(err, badger.ErrKeyNotFound)
+		if err != nil && !isNew {
+			slog.Error("findSnapshot", "error", err)
+			return false, err
+		}
+
+		if price, ok := prices[s.AssetID]; isNew && ok {
+			s.PriceUSD = &price
+		} else if !isNew {
+			s.PriceUSD = old.PriceUSD
+		}
+
 		if err := saveSnapshot(txn, s, job.Members, job.Threshold); err != nil {
 			slog.Error("saveSnapshot", "error", err)
-			return err
+			return false, err
+		}
+
+		if !isNew || initial {
+			continue
+		}
+
+		if err := enqueueWebhookEvent(txn, job.Members, job.Threshold, WebhookEventSnapshotCreated, s); err != nil {
+			slog.Error("enqueueWebhookEvent", "error", err)
+			return false, err
+		}
+
+		if err := enqueueVaultEvent(txn, job.Members, job.Threshold, VaultEventSnapshotCreated, s); err != nil {
+			slog.Error("enqueueVaultEvent", "error", err)
+			return false, err
+		}
+
+		if s.Amount.IsPositive() {
+			if err := enqueueNotification(txn, &Notification{
+				Type:      NotificationDeposit,
+				Members:   job.Members,
+				Threshold: job.Threshold,
+				AssetID:   s.AssetID,
+				Amount:    s.Amount,
+			}); err != nil {
+				slog.Error("enqueueNotification", "error", err)
+				return false, err
+			}
 		}
 	}
 
 	if err := saveVault(txn, vault); err != nil {
 		slog.Error("saveVault", "error", err)
-		return err
+		return false, err
 	}
 
-	return txn.Commit()
+	return active, txn.Commit()
 }
 
-func getNewOffset(a, b uint64) uint64 {
-	if a == 0 || b == 0 {
-		return max(a, b)
-	} else {
-		return min(a, b)
+// applyMultisigRequest 保存多签请求，状态或签名变化时推送事件，新的未完成请求会通知成员；
+// initial 为 vault 第一次同步，只保存不推送
+func applyMultisigRequest(txn *badger.Txn, r *MultisigRequest, initial bool) error {
+	old, err := findMultisigRequest(txn, r.ID)
+	isNew := errors.Is(err, badger.ErrKeyNotFound)
+	if err != nil && !isNew {
+		return err
 	}
+
+	if err := saveMultisigRequest(txn, r); err != nil {
+		return err
+	}
+
+	if initial {
+		return nil
+	}
+
+	if isNew || old.State != r.State || len(old.Signers) != len(r.Signers) {
+		if err := enqueueVaultEvent(txn, r.Members, r.Threshold, VaultEventRequestUpdated, r); err != nil {
+			return err
+		}
+	}
+
+	if isNew && r.IsOpen() {
+		if err := enqueueNotification(txn, &Notification{
+			Type:      NotificationRequest,
+			Members:   r.Members,
+			Threshold: r.Threshold,
+			AssetID:   r.AssetID,
+			Amount:    r.Amount,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncStage 记录同步 vault 当前所处的阶段
+type syncStage struct {
+	name  string
+	start time.Time
+}
+
+func newSyncStage(name string) *syncStage {
+	return &syncStage{name: name, start: time.Now()}
+}
+
+func (s *syncStage) next(name string) {
+	observeSync(s.name, s.start, nil)
+	s.name, s.start = name, time.Now()
+}
+
+func (s *syncStage) done(err error) {
+	observeSync(s.name, s.start, err)
 }
 
 func outputToSnapshot(output *mixin.SafeUtxo) *Snapshot {
@@ -228,7 +541,8 @@ func outputToSnapshot(output *mixin.SafeUtxo) *Snapshot {
 	return s
 }
 
-func requestToSnapshot(req *mixin.SafeMultisigRequest) *Snapshot {
+// requestToSnapshot 转出的对方地址是第一个不是 vault 自己（找零）的收款地址
+func requestToSnapshot(req *mixin.SafeMultisigRequest, members []string, threshold uint8) *Snapshot {
 	s := &Snapshot{
 		ID:              uuid.MustParse(req.RequestID),
 		CreatedAt:       req.CreatedAt,
@@ -237,9 +551,58 @@ func requestToSnapshot(req *mixin.SafeMultisigRequest) *Snapshot {
 		TransactionHash: req.TransactionHash,
 	}
 
+	vault := mixin.RequireNewMixAddress(members, threshold).String()
+	for _, receiver := range req.Receivers {
+		addr, err := mixin.NewMixAddress(receiver.Members, receiver.Threshold)
+		if err != nil || addr.String() == vault {
+			continue
+		}
+
+		s.Opponent = addr.String()
+		break
+	}
+
 	if b, err := hex.DecodeString(req.Extra); err == nil {
 		s.Memo = string(b)
 	}
 
 	return s
 }
+
+func requestToMultisigRequest(req *mixin.SafeMultisigRequest, members []string, threshold uint8, state string) *MultisigRequest {
+	r := &MultisigRequest{
+		ID:              uuid.MustParse(req.RequestID),
+		Members:         members,
+		Threshold:       threshold,
+		TransactionHash: req.TransactionHash,
+		AssetID:         req.AssetID,
+		Amount:          req.Amount,
+		Receivers:       []string{},
+		Signers:         req.Signers,
+		Missing:         []string{},
+		State:           state,
+		CreatedAt:       req.CreatedAt,
+		UpdatedAt:       time.Now(),
+	}
+
+	for _, receiver := range req.Receivers {
+		addr, err := mixin.NewMixAddress(receiver.Members, receiver.Threshold)
+		if err != nil {
+			continue
+		}
+
+		r.Receivers = append(r.Receivers, addr.String())
+	}
+
+	for _, m := range members {
+		if !govalidator.IsIn(m, req.Signers...) {
+			r.Missing = append(r.Missing, m)
+		}
+	}
+
+	if b, err := hex.DecodeString(req.Extra); err == nil {
+		r.Memo = string(b)
+	}
+
+	return r
+}
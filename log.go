@@ -6,14 +6,23 @@ import (
 	"fmt"
 
 	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/fox-one/mixin-sdk-go/v2/mixinnet"
 )
 
-func (s *Server) submit(ctx context.Context, utxo *mixin.SafeUtxo, id, msg string) error {
+// paymentClient 提交续费和退款交易需要的 Mixin 接口
+type paymentClient interface {
+	MakeTransaction(ctx context.Context, b *mixin.SafeTransactionBuilder, outputs []*mixin.TransactionOutput) (*mixinnet.Transaction, error)
+	SafeCreateTransactionRequest(ctx context.Context, input *mixin.SafeTransactionRequestInput) (*mixin.SafeTransactionRequest, error)
+	SafeSubmitTransactionRequest(ctx context.Context, input *mixin.SafeTransactionRequestInput) (*mixin.SafeTransactionRequest, error)
+	SafeReadTransactionRequest(ctx context.Context, idOrHash string) (*mixin.SafeTransactionRequest, error)
+}
+
+func (s *Server) submit(ctx context.Context, utxo *mixin.SafeUtxo, id, msg string, outputs ...*mixin.TransactionOutput) error {
 	b := mixin.NewSafeTransactionBuilder([]*mixin.SafeUtxo{utxo})
 	b.Hint = id
 	b.Memo = msg
 
-	tx, err := s.client.MakeTransaction(ctx, b, nil)
+	tx, err := s.payments.MakeTransaction(ctx, b, outputs)
 	if err != nil {
 		return fmt.Errorf("make transaction failed: %w", err)
 	}
@@ -24,7 +33,7 @@ func (s *Server) submit(ctx context.Context, utxo *mixin.SafeUtxo, id, msg strin
 	}
 
 	// prepare transaction
-	req, err := s.client.SafeCreateTransactionRequest(ctx, &mixin.SafeTransactionRequestInput{
+	req, err := s.payments.SafeCreateTransactionRequest(ctx, &mixin.SafeTransactionRequestInput{
 		RequestID:      id,
 		RawTransaction: raw,
 	})
@@ -44,10 +53,11 @@ func (s *Server) submit(ctx context.Context, utxo *mixin.SafeUtxo, id, msg strin
 	}
 
 	// submit transaction
-	if _, err := s.client.SafeSubmitTransactionRequest(ctx, &mixin.SafeTransactionRequestInput{
+	_, err = s.payments.SafeSubmitTransactionRequest(ctx, &mixin.SafeTransactionRequestInput{
 		RequestID:      id,
 		RawTransaction: hex.EncodeToString(data),
-	}); err != nil {
+	})
+	if err != nil {
 		return fmt.Errorf("submit transaction failed: %w", err)
 	}
 
@@ -0,0 +1,299 @@
+package cowallet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+// 按 Prometheus 文本格式输出指标，指标不多，不引入 client_golang
+
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricsMu   sync.Mutex
+	metricsList []metric
+
+	syncDuration     = newHistogram("cowallet_sync_duration_seconds", "Duration of vault sync stages.", "stage")
+	syncFailures     = newCounter("cowallet_sync_failures_total", "Failed vault sync stages.", "stage")
+	pendingJobs      = newGauge("cowallet_pending_jobs", "Number of jobs returned by listJobs.")
+	outputsOffset    = newGauge("cowallet_outputs_offset", "Sequence offset of the bot outputs loop.")
+	outputsLag       = newGauge("cowallet_outputs_lag_seconds", "Age of the last output handled when the bot outputs loop is behind, 0 when caught up.")
+	renewalsTotal    = newCounter("cowallet_renewals_total", "Renewals processed.", "plan")
+	mixinDuration    = newHistogram("cowallet_mixin_request_duration_seconds", "Latency of Mixin API calls.", "method")
+	mixinErrors      = newCounter("cowallet_mixin_request_errors_total", "Failed Mixin API calls.", "method")
+	assetCacheTotal  = newCounter("cowallet_asset_cache_requests_total", "Lookups of the safe asset cache.", "result")
+	httpDuration     = newHistogram("cowallet_http_request_duration_seconds", "Latency of HTTP handlers.", "method", "route", "code")
+	metricsStartedAt = time.Now()
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type series struct {
+	labels []string
+	value  float64
+
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metricVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+func register(v *metricVec) *metricVec {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	metricsList = append(metricsList, v)
+	return v
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return register(&metricVec{name: name, help: help, kind: "counter", labels: labels, series: map[string]*series{}})
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return register(&metricVec{name: name, help: help, kind: "gauge", labels: labels, series: map[string]*series{}})
+}
+
+func newHistogram(name, help string, labels ...string) *metricVec {
+	return register(&metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: defaultBuckets, series: map[string]*series{}})
+}
+
+func (v *metricVec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: want %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: values, counts: make([]uint64, len(v.buckets))}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+func (v *metricVec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.with(values).value += delta
+}
+
+func (v *metricVec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+func (v *metricVec) Set(val float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.with(values).value = val
+}
+
+func (v *metricVec) Observe(val float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.with(values)
+	for i, b := range v.buckets {
+		if val <= b {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += val
+	s.count++
+}
+
+func (v *metricVec) ObserveSince(start time.Time, values ...string) {
+	v.Observe(time.Since(start).Seconds(), values...)
+}
+
+// labelEscaper Prometheus 文本格式的标签值只转义反斜杠、双引号和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, formatLabel(name, values[i]))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, formatLabel(extra[i], extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+
+		for i, b := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labels, "le", formatFloat(b)), s.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labels), s.count)
+	}
+}
+
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	list := slices.Clone(metricsList)
+	metricsMu.Unlock()
+
+	for _, m := range list {
+		m.write(w)
+	}
+
+	fmt.Fprintf(w, "# HELP cowallet_uptime_seconds Seconds since the process started.\n# TYPE cowallet_uptime_seconds gauge\ncowallet_uptime_seconds %s\n", formatFloat(time.Since(metricsStartedAt).Seconds()))
+}
+
+// ServeMetrics 输出 Prometheus 指标，由 -metrics-addr 在内网单独监听，不需要登录
+func ServeMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(w)
+}
+
+// mixinTransport 统计所有 Mixin API 请求的耗时和错误，标签为请求方法和去掉 id 的路径
+type mixinTransport struct {
+	next http.RoundTripper
+}
+
+func (t *mixinTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+
+	method := r.Method + " " + mixinRoute(r.URL.Path)
+	mixinDuration.ObserveSince(start, method)
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		mixinErrors.Inc(method)
+	}
+
+	return resp, err
+}
+
+// mixinRoute 把路径里的 uuid、哈希和数字换成 :id，避免标签数量无限增长
+func mixinRoute(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, p := range parts {
+		if _, err := uuid.Parse(p); err == nil || isNumeric(p) || (len(p) >= 32 && isHex(p)) {
+			parts[i] = ":id"
+		}
+	}
+
+	return "/" + strings.Join(parts, "/")
+}
+
+func isNumeric(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+var instrumentMixinOnce sync.Once
+
+// instrumentMixin 所有 mixin.Client 共用同一个 http client，只需要包装一次
+func instrumentMixin() {
+	instrumentMixinOnce.Do(func() {
+		c := mixin.GetRestyClient()
+		next := c.GetClient().Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+
+		c.SetTransport(&mixinTransport{next: next})
+	})
+}
+
+// observeSync 记录同步 vault 每个阶段的耗时和失败次数
+func observeSync(stage string, start time.Time, err error) {
+	syncDuration.ObserveSince(start, stage)
+	if err != nil {
+		syncFailures.Inc(stage)
+	}
+}
+
+// handleMetrics 按路由模板统计 http 耗时，避免把 vault 地址等参数作为标签
+func handleMetrics(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unknown"
+		if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+			route = rc.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpDuration.ObserveSince(start, r.Method, route, strconv.Itoa(status))
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,79 @@
+package cowallet
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	c := &metricVec{name: "test_total", help: "Test counter.", kind: "counter", labels: []string{"method"}, series: map[string]*series{}}
+	c.Inc("a")
+	c.Add(2, "a")
+
+	h := &metricVec{name: "test_seconds", help: "Test histogram.", kind: "histogram", labels: []string{"route"}, buckets: []float64{0.1, 1}, series: map[string]*series{}}
+	h.Observe(0.5, "/vaults/{addr}")
+	h.Observe(2, "/vaults/{addr}")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	h.write(&buf)
+
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{method="a"} 3`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{route="/vaults/{addr}",le="0.1"} 0`,
+		`test_seconds_bucket{route="/vaults/{addr}",le="1"} 1`,
+		`test_seconds_bucket{route="/vaults/{addr}",le="+Inf"} 2`,
+		`test_seconds_sum{route="/vaults/{addr}"} 2.5`,
+		`test_seconds_count{route="/vaults/{addr}"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels([]string{"path"}, []string{"a\\b\"c\nd é"})
+	if want := `{path="a\\b\"c\nd é"}`; got != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestMixinRoute(t *testing.T) {
+	for path, want := range map[string]string{
+		"/safe/outputs": "/safe/outputs",
+		"/safe/transactions/3f0e0d7c-5c3b-4b4e-9e38-6f2f6c5f1a2b": "/safe/transactions/:id",
+		"/safe/outputs/" + strings.Repeat("ab", 32) + "/0":        "/safe/outputs/:id/:id",
+		"/me": "/me",
+	} {
+		if got := mixinRoute(path); got != want {
+			t.Errorf("%s: want %s, got %s", path, want, got)
+		}
+	}
+}
+
+func TestMixinTransport(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	client := &http.Client{Transport: &mixinTransport{next: http.DefaultTransport}}
+	resp, err := client.Get(svr.URL + "/safe/assets/3f0e0d7c-5c3b-4b4e-9e38-6f2f6c5f1a2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	mixinErrors.write(&buf)
+	if line := `cowallet_mixin_request_errors_total{method="GET /safe/assets/:id"} 1`; !strings.Contains(buf.String(), line+"\n") {
+		t.Fatalf("missing %q in\n%s", line, buf.String())
+	}
+}
@@ -0,0 +1,119 @@
+package cowallet
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const schemaVersionProperty = "schema_version"
+
+// Migration 升级数据格式，Migrate 必须是幂等的：执行完成后才会记录版本，
+// 中途退出时下次启动会从这个 migration 重新开始；dryRun 时只统计会修改的记录数，不写入
+type Migration struct {
+	Version int
+	Name    string
+	Migrate func(ctx context.Context, db *badger.DB, dryRun bool) (int, error)
+}
+
+// migrations 按版本顺序注册，已经发布的 migration 不能修改版本号
+var migrations = []*Migration{
+	{
+		Version: 1,
+		Name:    "index snapshot opponents, transaction hashes and directions",
+		Migrate: indexSnapshots,
+	},
+	{
+		Version: 2,
+		Name:    "backfill daily balance checkpoints",
+		Migrate: backfillBalances,
+	},
+	{
+		Version: 3,
+		Name:    "record vault expiry",
+		Migrate: backfillVaultExpiry,
+	},
+	{
+		Version: 4,
+		Name:    "scrub keystores from sync jobs",
+		Migrate: scrubJobTokens,
+	},
+}
+
+type MigrationResult struct {
+	Version  int           `json:"version"`
+	Name     string        `json:"name"`
+	Affected int           `json:"affected"`
+	Duration time.Duration `json:"duration"`
+}
+
+func SchemaVersion(db *badger.DB) (int, error) {
+	var version int
+	if err := ReadProperty(db, schemaVersionProperty, &version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// LatestSchemaVersion 当前代码支持的数据格式版本
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate 依次执行还没有执行的 migration，每执行完一个就记录版本。
+// dryRun 时不会写入任何数据，后面的 migration 看到的仍然是升级之前的数据
+func Migrate(ctx context.Context, db *badger.DB, dryRun bool) ([]*MigrationResult, error) {
+	return migrate(ctx, db, migrations, dryRun)
+}
+
+func migrate(ctx context.Context, db *badger.DB, migrations []*Migration, dryRun bool) ([]*MigrationResult, error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if latest := migrations[len(migrations)-1].Version; version > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than supported %d", version, latest)
+	}
+
+	var results []*MigrationResult
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		slog.Info("migrate", "version", m.Version, "name", m.Name, "dry_run", dryRun)
+
+		start := time.Now()
+		n, err := m.Migrate(ctx, db, dryRun)
+		if err != nil {
+			slog.Error("migrate", "version", m.Version, "error", err)
+			return results, fmt.Errorf("migration %d %q: %w", m.Version, m.Name, err)
+		}
+
+		results = append(results, &MigrationResult{
+			Version:  m.Version,
+			Name:     m.Name,
+			Affected: n,
+			Duration: time.Since(start),
+		})
+
+		if dryRun {
+			continue
+		}
+
+		if err := SaveProperty(db, schemaVersionProperty, m.Version); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
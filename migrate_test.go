@@ -0,0 +1,235 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestMigrate(t *testing.T) {
+	db := newTestDB(t)
+
+	ctx := context.Background()
+
+	var (
+		runs = map[int]int{}
+		fail = true
+	)
+
+	step := func(version int) func(ctx context.Context, db *badger.DB, dryRun bool) (int, error) {
+		return func(ctx context.Context, db *badger.DB, dryRun bool) (int, error) {
+			if version == 2 && fail && !dryRun {
+				return 0, errors.New("interrupted")
+			}
+
+			if !dryRun {
+				runs[version]++
+			}
+
+			return version * 10, nil
+		}
+	}
+
+	list := []*Migration{
+		{Version: 1, Name: "one", Migrate: step(1)},
+		{Version: 2, Name: "two", Migrate: step(2)},
+		{Version: 3, Name: "three", Migrate: step(3)},
+	}
+
+	results, err := migrate(ctx, db, list, true)
+	if err != nil || len(results) != 3 || results[1].Affected != 20 {
+		t.Fatalf("unexpected dry run results %v, %v", results, err)
+	}
+
+	if v, _ := SchemaVersion(db); v != 0 || len(runs) != 0 {
+		t.Fatalf("dry run should not write, version %d", v)
+	}
+
+	// 第二个 migration 失败后停在版本 1，再次执行从第二个开始
+	if _, err := migrate(ctx, db, list, false); err == nil {
+		t.Fatal("want migration error")
+	}
+
+	if v, _ := SchemaVersion(db); v != 1 {
+		t.Fatalf("want schema version 1, got %d", v)
+	}
+
+	fail = false
+	if results, err := migrate(ctx, db, list, false); err != nil || len(results) != 2 {
+		t.Fatalf("want 2 resumed migrations, got %d, %v", len(results), err)
+	}
+
+	if v, _ := SchemaVersion(db); v != 3 || runs[1] != 1 || runs[3] != 1 {
+		t.Fatalf("unexpected schema version %d, runs %v", v, runs)
+	}
+
+	if _, err := migrate(ctx, db, list[:2], false); err == nil {
+		t.Fatal("newer schema version should be refused")
+	}
+}
+
+// interruptCtx 前 after 次检查之后返回 context.Canceled，模拟执行到一半退出
+type interruptCtx struct {
+	context.Context
+	after int
+}
+
+func (c *interruptCtx) Err() error {
+	if c.after <= 0 {
+		return context.Canceled
+	}
+
+	c.after--
+	return nil
+}
+
+func TestBackfillBalancesResume(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		vaults = [][]string{
+			{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"},
+			{"8017d200-7870-4b82-b53f-74bae1d2dad7"},
+		}
+		assetID = "965e5c6e-434c-3fa9-b780-c50f43cd955c"
+		today   = time.Now().UTC().Truncate(24 * time.Hour)
+	)
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		for _, members := range vaults {
+			if err := saveVault(txn, &Vault{Members: members, Threshold: 1}); err != nil {
+				return err
+			}
+
+			for day := -5; day < 0; day++ {
+				if err := saveSnapshot(txn, &Snapshot{
+					ID:        uuid.New(),
+					CreatedAt: today.AddDate(0, 0, day).Add(time.Hour),
+					AssetID:   assetID,
+					Amount:    decimal.NewFromInt(1),
+				}, members, 1); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	backfilled := func() (n int) {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		for _, members := range vaults {
+			series, err := listDailyBalances(txn, members, 1, assetID, today.AddDate(0, 0, -5), today.AddDate(0, 0, -1))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, v := range series {
+				if len(v.Assets) == 0 {
+					break
+				}
+
+				if !v.Assets[0].Balance.Equal(decimal.NewFromInt(int64(i + 1))) {
+					t.Fatalf("%s: unexpected balance %s", v.Date, v.Assets[0].Balance)
+				}
+
+				n++
+			}
+		}
+
+		return n
+	}
+
+	// 补完第一个 vault 之后退出
+	if _, err := backfillBalances(&interruptCtx{Context: context.Background(), after: 1}, db, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want interrupted, got %v", err)
+	}
+
+	if n := backfilled(); n != 5 {
+		t.Fatalf("want 5 days backfilled before interruption, got %d", n)
+	}
+
+	// 重新执行只补剩下的 vault，已经补过的不会重复写入
+	n, err := backfillBalances(context.Background(), db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 5 {
+		t.Fatalf("want 5 days backfilled on resume, got %d", n)
+	}
+
+	if n := backfilled(); n != 10 {
+		t.Fatalf("want 10 days backfilled, got %d", n)
+	}
+
+	if n, err := backfillBalances(context.Background(), db, false); err != nil || n != 0 {
+		t.Fatalf("want nothing to backfill, got %d, %v", n, err)
+	}
+}
+
+func TestScrubJobTokens(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		key       = buildIndexKey(jobPrefix, hashMembers(members, threshold))
+	)
+
+	// 旧版本直接把 keystore 写进同步任务
+	legacy := `{"created_at":"2021-08-10T07:00:00Z","user":{"mixin_id":"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d","token":"{\"private_key\":\"x\"}"},"members":["f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"],"threshold":1}`
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(key, []byte(legacy)).WithTTL(time.Hour))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := scrubJobTokens(context.Background(), db, true); err != nil || n != 1 {
+		t.Fatalf("dry run: want 1, got %d, %v", n, err)
+	}
+
+	if n, err := scrubJobTokens(context.Background(), db, false); err != nil || n != 1 {
+		t.Fatalf("want 1 job scrubbed, got %d, %v", n, err)
+	}
+
+	if n, err := scrubJobTokens(context.Background(), db, false); err != nil || n != 0 {
+		t.Fatalf("want nothing to scrub, got %d, %v", n, err)
+	}
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ExpiresAt() == 0 {
+		t.Fatal("job ttl lost")
+	}
+
+	b, err := item.ValueCopy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "private_key") {
+		t.Fatalf("token not scrubbed: %s", b)
+	}
+
+	job, err := findJob(txn, members, threshold)
+	if err != nil || job.User == nil || job.User.MixinID != members[0] {
+		t.Fatalf("unexpected job %+v, %v", job, err)
+	}
+}
@@ -1,6 +1,7 @@
 package cowallet
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/fox-one/mixin-sdk-go/v2"
@@ -16,26 +17,32 @@ type Asset struct {
 	Signed   decimal.Decimal `json:"signed"`
 	Requests []string        `json:"requests"`
 
-	Asset *mixin.SafeAsset `json:"asset,omitempty"`
+	Asset    *mixin.SafeAsset `json:"asset,omitempty"`
+	ValueUSD *decimal.Decimal `json:"value_usd,omitempty"`
+	Value    *decimal.Decimal `json:"value,omitempty"` // 按展示法币计算
 }
 
 type Vault struct {
-	Members   []string  `json:"members"`
-	Threshold uint8     `json:"threshold"`
-	Offset    uint64    `json:"offset"`
-	Assets    []*Asset  `json:"assets"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Members      []string  `json:"members"`
+	Threshold    uint8     `json:"threshold"`
+	Offset       uint64    `json:"offset"`
+	Assets       []*Asset  `json:"assets"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	ReconciledAt time.Time `json:"reconciled_at"` // 上次从本地最早的 utxo 开始重新同步的时间
 }
 
 type Snapshot struct {
-	ID              uuid.UUID       `json:"id"`
-	CreatedAt       time.Time       `json:"created_at"`
-	AssetID         string          `json:"asset_id"`
-	Amount          decimal.Decimal `json:"amount"`
-	Opponent        string          `json:"opponent"`
-	Memo            string          `json:"memo"`
-	TransactionHash string          `json:"transaction_hash"`
-	OutputIndex     uint8           `json:"output_index"`
+	ID              uuid.UUID        `json:"id"`
+	CreatedAt       time.Time        `json:"created_at"`
+	AssetID         string           `json:"asset_id"`
+	Amount          decimal.Decimal  `json:"amount"`
+	Opponent        string           `json:"opponent"`
+	Memo            string           `json:"memo"`
+	TransactionHash string           `json:"transaction_hash"`
+	OutputIndex     uint8            `json:"output_index"`
+	PriceUSD        *decimal.Decimal `json:"price_usd,omitempty"` // 入库时的价格
+	Value           *decimal.Decimal `json:"value,omitempty"`     // 按入库时的价格和展示法币计算，不保存
+	Currency        string           `json:"currency,omitempty"`
 }
 
 type Address struct {
@@ -47,17 +54,171 @@ type Address struct {
 }
 
 type Renew struct {
+	ID          uuid.UUID       `json:"id"`
+	Sequence    uint64          `json:"sequence"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Members     []string        `json:"members"`
+	Threshold   uint8           `json:"threshold"`
+	Sender      string          `json:"sender"`
+	Asset       string          `json:"asset"`
+	Amount      decimal.Decimal `json:"amount"`
+	Period      int64           `json:"period"` // in seconds
+	Plan        string          `json:"plan,omitempty"`
+	PlanVersion int64           `json:"plan_version,omitempty"` // 付款时的套餐版本，可以用 GET /plans/{id} 查到
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	Reason      string          `json:"reason,omitempty"`   // 运营手动授予时填写
+	Operator    string          `json:"operator,omitempty"` // 手动授予的管理员
+}
+
+// VaultExpiry vault 所有续费里最晚的到期时间和最大的 sequence
+type VaultExpiry struct {
+	ExpiredAt time.Time `json:"expired_at"`
+	Sequence  uint64    `json:"sequence"`
+}
+
+type Refund struct {
 	ID        uuid.UUID       `json:"id"`
+	RequestID string          `json:"request_id"`
 	Sequence  uint64          `json:"sequence"`
 	CreatedAt time.Time       `json:"created_at"`
+	Receiver  string          `json:"receiver"`
+	Asset     string          `json:"asset"`
+	Amount    decimal.Decimal `json:"amount"`
+	Reason    string          `json:"reason"`
+}
+
+const (
+	InvoiceStatePending = "pending"
+	InvoiceStatePaid    = "paid"
+	InvoiceStateExpired = "expired"
+)
+
+type Invoice struct {
+	ID        uuid.UUID       `json:"id"` // trace id
 	Members   []string        `json:"members"`
 	Threshold uint8           `json:"threshold"`
-	Sender    string          `json:"sender"`
+	Plan      string          `json:"plan"`
 	Asset     string          `json:"asset"`
 	Amount    decimal.Decimal `json:"amount"`
 	Period    int64           `json:"period"` // in seconds
-	From      time.Time       `json:"from"`
-	To        time.Time       `json:"to"`
+	Memo      string          `json:"memo"`
+	PayURL    string          `json:"pay_url"`
+	State     string          `json:"state"`
+	Renew     *uuid.UUID      `json:"renew,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiredAt time.Time       `json:"expired_at"`
+	PaidAt    *time.Time      `json:"paid_at,omitempty"`
+}
+
+const (
+	WebhookEventSnapshotCreated = "snapshot.created"
+	WebhookEventVaultRenewed    = "vault.renewed"
+)
+
+const (
+	WebhookDeliveryStatePending   = "pending"
+	WebhookDeliveryStateDelivered = "delivered"
+	WebhookDeliveryStateFailed    = "failed"
+)
+
+type Webhook struct {
+	ID        uuid.UUID `json:"id"`
+	User      string    `json:"user"`
+	Members   []string  `json:"members"`
+	Threshold uint8     `json:"threshold"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookEvent struct {
+	ID        uuid.UUID       `json:"id"`
+	Type      string          `json:"type"`
+	Vault     string          `json:"vault"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID            uuid.UUID     `json:"id"`
+	Webhook       uuid.UUID     `json:"webhook"`
+	Event         *WebhookEvent `json:"event"`
+	State         string        `json:"state"`
+	Attempts      int           `json:"attempts"`
+	StatusCode    int           `json:"status_code"`
+	Error         string        `json:"error,omitempty"`
+	NextAttemptAt time.Time     `json:"next_attempt_at"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+const (
+	NotificationDeposit = "deposit"
+	NotificationRequest = "request"
+	NotificationRenewal = "renewal"
+	NotificationExpiry  = "expiry"
+)
+
+type Notification struct {
+	ID        uuid.UUID       `json:"id"`
+	Type      string          `json:"type"`
+	Members   []string        `json:"members"`
+	Threshold uint8           `json:"threshold"`
+	AssetID   string          `json:"asset_id,omitempty"`
+	Amount    decimal.Decimal `json:"amount"`
+	Until     time.Time       `json:"until,omitempty"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt time.Time       `json:"created_at"`
+
+	// 下一次发送的时间，旧的记录没有这个字段，按 CreatedAt 排队
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+type NotificationSetting struct {
+	User      uuid.UUID `json:"user"`
+	Disabled  bool      `json:"disabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Session struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      string     `json:"user_id"`
+	RefreshHash string     `json:"refresh_hash"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiredAt   time.Time  `json:"expired_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Credential 加密保存的用户 OAuth access token，只用于后台同步
+type Credential struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Sealed    string    `json:"sealed"`
+	ExpiredAt time.Time `json:"expired_at"` // access token 的过期时间
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (v *Credential) Expired() bool {
+	return time.Now().After(v.ExpiredAt)
+}
+
+type Schedule struct {
+	Members           []string  `json:"members"`
+	Threshold         uint8     `json:"threshold"`
+	NextRunAt         time.Time `json:"next_run_at"`
+	LastRunAt         time.Time `json:"last_run_at"`
+	LastActivityAt    time.Time `json:"last_activity_at"`
+	Failures          int       `json:"failures"`
+	LastError         string    `json:"last_error,omitempty"`
+	CredentialMissing bool      `json:"credential_missing"` // 同步使用的 access token 不存在或者已经过期，需要有成员重新登录
+}
+
+type Plan struct {
+	ID      string          `json:"id"`
+	Version int64           `json:"version,omitempty"` // 保存到数据库时分配，内容变化时递增
+	AssetID string          `json:"asset_id"`
+	Amount  decimal.Decimal `json:"amount"`
+	Months  int64           `json:"months"`
 }
 
 type Remark struct {
@@ -67,3 +228,64 @@ type Remark struct {
 	Name      string    `json:"name"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
+
+const (
+	MultisigRequestStateInitial  = "initial"
+	MultisigRequestStateSigned   = "signed"
+	MultisigRequestStateSpent    = "spent"
+	MultisigRequestStateUnlocked = "unlocked"
+)
+
+type MultisigRequest struct {
+	ID              uuid.UUID       `json:"id"`
+	Members         []string        `json:"members"`
+	Threshold       uint8           `json:"threshold"`
+	TransactionHash string          `json:"transaction_hash"`
+	AssetID         string          `json:"asset_id"`
+	Amount          decimal.Decimal `json:"amount"`
+	Receivers       []string        `json:"receivers"`
+	Memo            string          `json:"memo"`
+	Signers         []string        `json:"signers"`
+	Missing         []string        `json:"missing"`
+	State           string          `json:"state"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+func (r *MultisigRequest) IsOpen() bool {
+	return r.State == MultisigRequestStateInitial || r.State == MultisigRequestStateSigned
+}
+
+// Utxo vault 本地保存的未花费 utxo，花费之后删除
+type Utxo struct {
+	ID        uuid.UUID       `json:"id"`
+	AssetID   string          `json:"asset_id"`
+	Hash      string          `json:"hash"`
+	Amount    decimal.Decimal `json:"amount"`
+	State     string          `json:"state"`
+	SignedBy  string          `json:"signed_by,omitempty"`
+	Sequence  uint64          `json:"sequence"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+const (
+	VaultEventBalanceChanged  = "balance.changed"
+	VaultEventSnapshotCreated = "snapshot.created"
+	VaultEventRequestUpdated  = "request.updated"
+)
+
+// VaultEvent vault 的变动事件，id 在每个 vault 内递增，断线重连后可以从上次的 id 继续
+type VaultEvent struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// BalanceCheckpoint vault 某个资产在某一天（UTC）结束时的余额
+type BalanceCheckpoint struct {
+	Date      string          `json:"date"`
+	AssetID   string          `json:"asset_id"`
+	Balance   decimal.Decimal `json:"balance"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
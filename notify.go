@@ -1 +1,199 @@
 package cowallet
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+const maxNotificationAttempts = 10
+
+type Message struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Text   string `json:"text"`
+}
+
+type Notifier interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// mixinNotifier 通过机器人给用户发送 Mixin Messenger 消息
+type mixinNotifier struct {
+	client *mixin.Client
+}
+
+func NewMixinNotifier(client *mixin.Client) Notifier {
+	return &mixinNotifier{client: client}
+}
+
+func (n *mixinNotifier) Send(ctx context.Context, msg *Message) error {
+	err := n.client.SendMessage(ctx, &mixin.MessageRequest{
+		ConversationID: mixin.UniqueConversationID(n.client.ClientID, msg.UserID),
+		RecipientID:    msg.UserID,
+		MessageID:      msg.ID,
+		Category:       mixin.MessageCategoryPlainText,
+		Data:           base64.StdEncoding.EncodeToString([]byte(msg.Text)),
+	})
+	return err
+}
+
+// MemoryNotifier 把消息保存在内存里，用于测试
+type MemoryNotifier struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func NewMemoryNotifier() *MemoryNotifier {
+	return &MemoryNotifier{}
+}
+
+func (n *MemoryNotifier) Send(_ context.Context, msg *Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.messages = append(n.messages, msg)
+	return nil
+}
+
+func (n *MemoryNotifier) Messages() []*Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]*Message(nil), n.messages...)
+}
+
+// enqueueNotification 通知和触发它的数据在同一个事务里保存，由 LoopNotifications 发送
+func enqueueNotification(txn *badger.Txn, n *Notification) error {
+	n.ID = uuid.New()
+	n.CreatedAt = time.Now()
+	n.NextAttemptAt = n.CreatedAt
+	return saveNotification(txn, n)
+}
+
+func (s *Server) LoopNotifications(ctx context.Context) error {
+	for {
+		_ = s.loopNotifications(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) loopNotifications(ctx context.Context) error {
+	txn := s.db.NewTransaction(false)
+	notifications, err := listNotifications(txn, time.Now(), 100)
+	txn.Discard()
+
+	if err != nil {
+		slog.Error("listNotifications", "err", err)
+		return err
+	}
+
+	for _, n := range notifications {
+		sendErr := s.sendNotification(ctx, n)
+		if sendErr != nil {
+			slog.Error("sendNotification", "id", n.ID, "err", sendErr)
+		}
+
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			if err := deleteNotification(txn, n); err != nil {
+				return err
+			}
+
+			if sendErr == nil || n.Attempts+1 >= maxNotificationAttempts {
+				return nil
+			}
+
+			// 和 webhook 使用同样的指数退避，失败的通知不会每秒重试
+			n.Attempts++
+			n.NextAttemptAt = time.Now().Add(webhookBackoff(n.Attempts))
+			return saveNotification(txn, n)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendNotification 给没有关闭通知的成员发送消息，消息 id 由通知 id 和用户推导，重试时不会重复
+func (s *Server) sendNotification(ctx context.Context, n *Notification) error {
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	// hashMembers 会对成员排序，遍历副本
+	for _, member := range slices.Clone(n.Members) {
+		user, err := uuid.Parse(member)
+		if err != nil {
+			continue
+		}
+
+		setting, err := getNotificationSetting(txn, user)
+		if err != nil {
+			return err
+		}
+
+		if setting.Disabled {
+			continue
+		}
+
+		name, err := getRemarkName(txn, user, n.Members, n.Threshold)
+		if err != nil {
+			return err
+		}
+
+		msg := &Message{
+			ID:     uuid.NewSHA1(n.ID, []byte(member)).String(),
+			UserID: member,
+			Text:   s.renderNotification(ctx, n, name),
+		}
+
+		if err := s.notifier.Send(ctx, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) renderNotification(ctx context.Context, n *Notification, name string) string {
+	if name == "" {
+		name = mixin.RequireNewMixAddress(n.Members, n.Threshold).String()
+	}
+
+	symbol := n.AssetID
+	if n.AssetID != "" {
+		if asset, err := s.getSafeAsset(ctx, n.AssetID); err == nil {
+			symbol = asset.Symbol
+		}
+	}
+
+	switch n.Type {
+	case NotificationDeposit:
+		return fmt.Sprintf("Vault %s received %s %s", name, n.Amount, symbol)
+	case NotificationRequest:
+		return fmt.Sprintf("New transfer request of %s %s in vault %s is waiting for signatures", n.Amount.Abs(), symbol, name)
+	case NotificationRenewal:
+		return fmt.Sprintf("Vault %s renewed with %s %s, valid until %s", name, n.Amount, symbol, n.Until.UTC().Format(time.DateTime+" MST"))
+	case NotificationExpiry:
+		if time.Now().Before(n.Until) {
+			return fmt.Sprintf("Subscription of vault %s expires at %s, renew to keep it in sync", name, n.Until.UTC().Format(time.DateTime+" MST"))
+		}
+
+		return fmt.Sprintf("Subscription of vault %s expired at %s, renew to keep it in sync", name, n.Until.UTC().Format(time.DateTime+" MST"))
+	}
+
+	return ""
+}
@@ -0,0 +1,111 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestSendNotification(t *testing.T) {
+	db := newTestDB(t)
+
+	const usdt = "4d8c508b-91c5-375b-92b0-ee702ed2dac5"
+	const (
+		alice = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+		bob   = "8017d200-7870-4b82-b53f-74bae1d2dad7"
+	)
+
+	notifier := NewMemoryNotifier()
+	s := newTestServer(t, db, Config{Notifier: notifier})
+	s.assets.Set(usdt, &mixin.SafeAsset{AssetID: usdt, Symbol: "USDT"})
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := saveNotificationSetting(txn, &NotificationSetting{
+			User:     uuid.MustParse(bob),
+			Disabled: true,
+		}); err != nil {
+			return err
+		}
+
+		return enqueueNotification(txn, &Notification{
+			Type:      NotificationDeposit,
+			Members:   []string{alice, bob},
+			Threshold: 1,
+			AssetID:   usdt,
+			Amount:    decimal.NewFromInt(1),
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loopNotifications(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := notifier.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("want 1 message, got %d", len(messages))
+	}
+
+	if messages[0].UserID != alice || !strings.Contains(messages[0].Text, "1 USDT") {
+		t.Fatalf("unexpected message %+v", messages[0])
+	}
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	if pending, err := listNotifications(txn, time.Now(), 10); err != nil || len(pending) != 0 {
+		t.Fatalf("notification queue not drained: %d %v", len(pending), err)
+	}
+}
+
+type failNotifier struct{}
+
+func (failNotifier) Send(context.Context, *Message) error {
+	return errors.New("send failed")
+}
+
+func TestNotificationBackoff(t *testing.T) {
+	db := newTestDB(t)
+
+	const alice = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+	s := newTestServer(t, db, Config{Notifier: failNotifier{}})
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return enqueueNotification(txn, &Notification{
+			Type:      NotificationDeposit,
+			Members:   []string{alice},
+			Threshold: 1,
+			Amount:    decimal.NewFromInt(1),
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loopNotifications(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	if due, err := listNotifications(txn, time.Now(), 10); err != nil || len(due) != 0 {
+		t.Fatalf("failed notification retried immediately: %d %v", len(due), err)
+	}
+
+	later, err := listNotifications(txn, time.Now().Add(webhookBackoff(1)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(later) != 1 || later[0].Attempts != 1 {
+		t.Fatalf("want 1 notification with 1 attempt, got %d", len(later))
+	}
+}
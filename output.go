@@ -3,13 +3,14 @@ package cowallet
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"log/slog"
 	"time"
 
+	"github.com/asaskevich/govalidator"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/fox-one/mixin-sdk-go/v2"
 	"github.com/google/uuid"
-	"github.com/shopspring/decimal"
 )
 
 const (
@@ -39,6 +40,8 @@ func (s *Server) loopOutputs(ctx context.Context) error {
 		return err
 	}
 
+	outputsOffset.Set(float64(opt.Offset))
+
 	outputs, err := s.client.SafeListUtxos(ctx, opt)
 	if err != nil {
 		slog.Error("SafeListUtxos", "err", err)
@@ -46,6 +49,7 @@ func (s *Server) loopOutputs(ctx context.Context) error {
 	}
 
 	if len(outputs) == 0 {
+		outputsLag.Set(0)
 		return nil
 	}
 
@@ -54,18 +58,43 @@ func (s *Server) loopOutputs(ctx context.Context) error {
 	txn := s.db.NewTransaction(true)
 	defer txn.Discard()
 
+	// 续费在提交之后才计入指标，提交失败时会重新处理这些 output
+	var renewed []string
 	for _, output := range outputs {
 		if err := s.handleOutput(ctx, txn, output); err != nil {
 			slog.Error("handleOutput", "err", err)
 			return err
 		}
 
+		if id, err := uuid.Parse(output.RequestID); err == nil {
+			if r, err := findRenew(txn, id); err == nil && r.Sequence == output.Sequence {
+				renewed = append(renewed, r.Plan)
+			}
+		}
+
 		if err := saveProperty(txn, outputOffsetProperty, output.Sequence+1); err != nil {
 			return err
 		}
 	}
 
-	return txn.Commit()
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	for _, plan := range renewed {
+		renewalsTotal.Inc(plan)
+	}
+
+	// 一次没有处理完说明还有积压，用最后一个 output 的时间估算延迟
+	last := outputs[len(outputs)-1]
+	outputsOffset.Set(float64(last.Sequence + 1))
+	if len(outputs) < opt.Limit {
+		outputsLag.Set(0)
+	} else {
+		outputsLag.Set(time.Since(last.CreatedAt).Seconds())
+	}
+
+	return nil
 }
 
 func (s *Server) handleOutput(ctx context.Context, txn *badger.Txn, output *mixin.SafeUtxo) error {
@@ -83,68 +112,182 @@ func (s *Server) handleOutput(ctx context.Context, txn *badger.Txn, output *mixi
 
 	b, err := hex.DecodeString(output.Extra)
 	if err != nil {
-		return nil
+		return s.refund(ctx, txn, output, "invalid memo")
 	}
 
-	addr, err := mixin.MixAddressFromString(string(b))
+	cmd, err := DecodeCommand(b)
 	if err != nil {
-		return nil
+		slog.Info("decode command", "err", err)
+		return s.refund(ctx, txn, output, "invalid memo")
 	}
 
+	switch cmd.Action {
+	case CommandRenewVault:
+		return s.handleRenewCommand(ctx, txn, output, cmd.Address)
+	case CommandAddAddress, CommandDelAddress:
+		return s.handleAddressCommand(ctx, txn, output, cmd)
+	}
+
+	return nil
+}
+
+func (s *Server) handleRenewCommand(ctx context.Context, txn *badger.Txn, output *mixin.SafeUtxo, addr *mixin.MixAddress) error {
 	slog.Info("renew vault", "addr", addr.String())
 
+	plan, period := matchPlan(s.cfg.Plans, output)
+
 	if output.State != mixin.SafeUtxoStateUnspent {
-		req, err := s.client.SafeReadTransactionRequest(ctx, output.SignedBy)
+		req, err := s.payments.SafeReadTransactionRequest(ctx, output.SignedBy)
 		if err != nil {
 			slog.Error("SafeReadTransactionRequest", "err", err)
 			return err
 		}
 
-		extra, err := hex.DecodeString(req.Extra)
-		if err != nil {
-			return nil
+		if plan, version, period, ok := decodeRenewExtra(req.Extra, output.OutputID); ok {
+			return s.renewVault(txn, output, addr, plan, version, period)
 		}
 
-		var (
-			id     uuid.UUID
-			period int64
-		)
-
-		if err := decodeIndexKey(extra, renewPrefix, &id, &period); err != nil {
-			return nil
+		// 不是续费交易，可能是已经提交但还没有保存记录的退款，由 refund 确认
+		reason := renewRefundReason(plan, period)
+		if reason == "" {
+			reason = "plan changed"
 		}
 
-		if id.String() != output.OutputID {
-			return nil
-		}
+		return s.refund(ctx, txn, output, reason)
+	}
+
+	if reason := renewRefundReason(plan, period); reason != "" {
+		return s.refund(ctx, txn, output, reason)
+	}
+
+	extra := buildIndexKey(renewPrefix, uuid.MustParse(output.OutputID), period, plan.ID, plan.Version)
+	if err := s.submit(ctx, output, output.OutputID, string(extra)); err != nil {
+		return err
+	}
+
+	return s.renewVault(txn, output, addr, plan.ID, plan.Version, period)
+}
 
-		return s.renewVault(txn, output, addr, period)
+// renewRefundReason 付款不能用来续费时返回退款原因
+func renewRefundReason(plan *Plan, period int64) string {
+	if plan == nil {
+		return "unsupported asset"
 	}
 
-	period := s.getRenewPeriod(output)
 	if period <= 0 {
+		return "amount too small"
+	}
+
+	return ""
+}
+
+// decodeRenewExtra 解析续费交易的 extra，确认交易花掉的就是这个 output
+func decodeRenewExtra(s, outputID string) (plan string, version, period int64, ok bool) {
+	extra, err := hex.DecodeString(s)
+	if err != nil {
+		return "", 0, 0, false
+	}
+
+	var id uuid.UUID
+	if err := decodeIndexKey(extra, renewPrefix, &id, &period); err != nil || id.String() != outputID {
+		return "", 0, 0, false
+	}
+
+	// 旧版本的 extra 里没有记录套餐和套餐版本
+	if err := decodeIndexKey(extra, renewPrefix, &id, &period, &plan, &version); err != nil {
+		version = 0
+		_ = decodeIndexKey(extra, renewPrefix, &id, &period, &plan)
+	}
+
+	return plan, version, period, true
+}
+
+// refund 把无法处理的转账原路退回，退款记录和 offset 在同一个事务里保存，
+// 交易的 request id 由 output id 推导，重启后也不会重复退款
+func (s *Server) refund(ctx context.Context, txn *badger.Txn, output *mixin.SafeUtxo, reason string) error {
+	// 没有付款人或者是自己的找零
+	if len(output.Senders) == 0 || govalidator.IsIn(s.client.ClientID, output.Senders...) {
 		return nil
 	}
 
-	extra := buildIndexKey(renewPrefix, uuid.MustParse(output.OutputID), period)
-	if err := s.submit(ctx, output, output.OutputID, string(extra)); err != nil {
+	id := uuid.MustParse(output.OutputID)
+	if _, err := findRefund(txn, id); err == nil {
+		return nil
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
 		return err
 	}
 
-	return s.renewVault(txn, output, addr, period)
+	receiver := mixin.RequireNewMixAddress(output.Senders, output.SendersThreshold)
+	r := &Refund{
+		ID:        id,
+		RequestID: uuid.NewSHA1(id, refundPrefix).String(),
+		Sequence:  output.Sequence,
+		CreatedAt: time.Now(),
+		Receiver:  receiver.String(),
+		Asset:     output.AssetID,
+		Amount:    output.Amount,
+		Reason:    reason,
+	}
+
+	// 交易已经提交但退款记录没有保存，确认花掉这个 output 的就是退款交易后补上记录
+	if output.State != mixin.SafeUtxoStateUnspent {
+		req, err := s.payments.SafeReadTransactionRequest(ctx, output.SignedBy)
+		if err != nil {
+			slog.Error("SafeReadTransactionRequest", "err", err)
+			return err
+		}
+
+		if req.RequestID != r.RequestID {
+			return nil
+		}
+
+		slog.Info("refund resumed", "output", output.OutputID, "receiver", r.Receiver, "reason", reason)
+		return saveRefund(txn, r)
+	}
+
+	slog.Info("refund", "output", output.OutputID, "receiver", r.Receiver, "reason", reason)
+
+	// 上一次提交中断时用同样的 request id 重新提交
+	if err := s.submit(ctx, output, r.RequestID, "cowallet refund: "+reason, &mixin.TransactionOutput{
+		Address: receiver,
+		Amount:  output.Amount,
+	}); err != nil {
+		return err
+	}
+
+	return saveRefund(txn, r)
 }
 
-func (s *Server) getRenewPeriod(utxo *mixin.SafeUtxo) int64 {
-	if utxo.AssetID != s.cfg.PayAssetID {
-		return 0
+// handleAddressCommand 更新付款人的地址簿，只接受单个用户的转账，付款在更新之后原路退回
+func (s *Server) handleAddressCommand(ctx context.Context, txn *badger.Txn, output *mixin.SafeUtxo, cmd *Command) error {
+	if len(output.Senders) != 1 || output.SendersThreshold != 1 {
+		return s.refund(ctx, txn, output, "address book requires a single sender")
+	}
+
+	user, err := uuid.Parse(output.Senders[0])
+	if err != nil {
+		return s.refund(ctx, txn, output, "invalid sender")
 	}
 
-	const month = 30 * 24 * time.Hour
-	base := decimal.NewFromFloat(month.Seconds())
-	return utxo.Amount.Div(s.cfg.PayAmount).Mul(base).IntPart()
+	v := Address{
+		UserID:    user,
+		Members:   cmd.Address.Members(),
+		Threshold: cmd.Address.Threshold,
+	}
+
+	if cmd.Action == CommandAddAddress {
+		v.Label = cmd.Label
+	}
+
+	slog.Info("update address", "user", user, "addr", cmd.Address.String(), "label", v.Label)
+	if err := saveAddress(txn, v); err != nil {
+		return err
+	}
+
+	return s.refund(ctx, txn, output, "address book updated")
 }
 
-func (s *Server) renewVault(txn *badger.Txn, output *mixin.SafeUtxo, addr *mixin.MixAddress, period int64) error {
+func (s *Server) renewVault(txn *badger.Txn, output *mixin.SafeUtxo, addr *mixin.MixAddress, plan string, planVersion, period int64) error {
 	from, seq, err := getVaultExpiredAt(txn, addr.Members(), addr.Threshold)
 	if err != nil {
 		slog.Error("getVaultExpiredAt", "err", err)
@@ -158,16 +301,18 @@ func (s *Server) renewVault(txn *badger.Txn, output *mixin.SafeUtxo, addr *mixin
 	from = maxDate(from, output.CreatedAt)
 
 	r := &Renew{
-		ID:        uuid.MustParse(output.RequestID),
-		CreatedAt: output.CreatedAt,
-		Sequence:  output.Sequence,
-		Members:   addr.Members(),
-		Threshold: addr.Threshold,
-		Asset:     output.AssetID,
-		Amount:    output.Amount,
-		Period:    period,
-		From:      from,
-		To:        from.Add((time.Duration(period) * time.Second)),
+		ID:          uuid.MustParse(output.RequestID),
+		CreatedAt:   output.CreatedAt,
+		Sequence:    output.Sequence,
+		Members:     addr.Members(),
+		Threshold:   addr.Threshold,
+		Asset:       output.AssetID,
+		Amount:      output.Amount,
+		Period:      period,
+		Plan:        plan,
+		PlanVersion: planVersion,
+		From:        from,
+		To:          from.Add((time.Duration(period) * time.Second)),
 	}
 
 	if len(output.Senders) > 0 {
@@ -179,15 +324,30 @@ func (s *Server) renewVault(txn *badger.Txn, output *mixin.SafeUtxo, addr *mixin
 		return err
 	}
 
-	job := &Job{
-		CreatedAt: time.Now(),
+	if err := markInvoicePaid(txn, r); err != nil {
+		return err
+	}
+
+	if err := enqueueWebhookEvent(txn, r.Members, r.Threshold, WebhookEventVaultRenewed, r); err != nil {
+		return err
+	}
+
+	if err := enqueueNotification(txn, &Notification{
+		Type:      NotificationRenewal,
 		Members:   r.Members,
 		Threshold: r.Threshold,
+		AssetID:   r.Asset,
+		Amount:    r.Amount,
+		Until:     r.To,
+	}); err != nil {
+		return err
 	}
 
-	if err := saveJob(txn, job, time.Minute); err != nil {
-		return err
+	job := &Job{
+		CreatedAt: time.Now(),
+		Members:   r.Members,
+		Threshold: r.Threshold,
 	}
 
-	return nil
+	return saveJob(txn, job, time.Minute)
 }
@@ -0,0 +1,126 @@
+package cowallet
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/fox-one/mixin-sdk-go/v2/mixinnet"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type fakePaymentClient struct {
+	requests  map[string]*mixin.SafeTransactionRequest
+	submitted []string
+}
+
+func (c *fakePaymentClient) MakeTransaction(_ context.Context, _ *mixin.SafeTransactionBuilder, _ []*mixin.TransactionOutput) (*mixinnet.Transaction, error) {
+	return &mixinnet.Transaction{}, nil
+}
+
+func (c *fakePaymentClient) SafeCreateTransactionRequest(_ context.Context, input *mixin.SafeTransactionRequestInput) (*mixin.SafeTransactionRequest, error) {
+	return &mixin.SafeTransactionRequest{RequestID: input.RequestID}, nil
+}
+
+func (c *fakePaymentClient) SafeSubmitTransactionRequest(_ context.Context, input *mixin.SafeTransactionRequestInput) (*mixin.SafeTransactionRequest, error) {
+	c.submitted = append(c.submitted, input.RequestID)
+	return &mixin.SafeTransactionRequest{RequestID: input.RequestID}, nil
+}
+
+func (c *fakePaymentClient) SafeReadTransactionRequest(_ context.Context, id string) (*mixin.SafeTransactionRequest, error) {
+	return c.requests[id], nil
+}
+
+func TestRenewRefunds(t *testing.T) {
+	const usdt = "4d8c508b-91c5-375b-92b0-ee702ed2dac5"
+
+	vault := mixin.RequireNewMixAddress([]string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}, 1)
+	newOutput := func(amount string, state mixin.SafeUtxoState) *mixin.SafeUtxo {
+		return &mixin.SafeUtxo{
+			OutputID:         uuid.NewString(),
+			RequestID:        uuid.NewString(),
+			Sequence:         1,
+			AssetID:          usdt,
+			Amount:           decimal.RequireFromString(amount),
+			Senders:          []string{"8017d200-7870-4b82-b53f-74bae1d2dad7"},
+			SendersThreshold: 1,
+			State:            state,
+			SignedBy:         uuid.NewString(),
+		}
+	}
+
+	refundID := func(output *mixin.SafeUtxo) string {
+		return uuid.NewSHA1(uuid.MustParse(output.OutputID), refundPrefix).String()
+	}
+
+	// 交易已经提交但退款记录没有保存
+	resumed := newOutput("0.5", mixin.SafeUtxoStateSpent)
+	// 其他交易花掉的 output 不退款
+	other := newOutput("0.5", mixin.SafeUtxoStateSpent)
+	// 续费交易花掉的 output 补上续费记录
+	renewed := newOutput("10", mixin.SafeUtxoStateSpent)
+
+	client := &fakePaymentClient{
+		requests: map[string]*mixin.SafeTransactionRequest{
+			resumed.SignedBy: {RequestID: refundID(resumed)},
+			other.SignedBy:   {RequestID: uuid.NewString()},
+			renewed.SignedBy: {
+				RequestID: renewed.OutputID,
+				Extra:     hex.EncodeToString(buildIndexKey(renewPrefix, uuid.MustParse(renewed.OutputID), int64(month.Seconds()), "monthly", int64(1))),
+			},
+		},
+	}
+
+	cases := []struct {
+		name      string
+		output    *mixin.SafeUtxo
+		reason    string
+		submitted bool
+		renewed   bool
+	}{
+		{"amount too small", newOutput("0.5", mixin.SafeUtxoStateUnspent), "amount too small", true, false},
+		{"refund resumed", resumed, "amount too small", false, false},
+		{"spent by other tx", other, "", false, false},
+		{"renew resumed", renewed, "", false, true},
+		{"renew", newOutput("10", mixin.SafeUtxoStateUnspent), "", true, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newTestDB(t)
+			s := newTestServer(t, db, Config{})
+			s.payments = client
+			client.submitted = nil
+
+			if err := db.Update(func(txn *badger.Txn) error {
+				return s.handleRenewCommand(context.Background(), txn, c.output, vault)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if submitted := len(client.submitted) > 0; submitted != c.submitted {
+				t.Fatalf("want submitted %v, got %v", c.submitted, client.submitted)
+			}
+
+			txn := db.NewTransaction(false)
+			defer txn.Discard()
+
+			r, err := findRefund(txn, uuid.MustParse(c.output.OutputID))
+			if c.reason == "" {
+				if err == nil {
+					t.Fatalf("unexpected refund %+v", r)
+				}
+			} else if err != nil || r.Reason != c.reason {
+				t.Fatalf("want refund %q, got %+v, %v", c.reason, r, err)
+			}
+
+			_, err = findRenew(txn, uuid.MustParse(c.output.RequestID))
+			if renewed := err == nil; renewed != c.renewed {
+				t.Fatalf("want renewed %v, got %v", c.renewed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package cowallet
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
+	"github.com/twitchtv/twirp"
+)
+
+const month = 30 * 24 * time.Hour
+
+func ValidatePlans(plans []*Plan) error {
+	if len(plans) == 0 {
+		return fmt.Errorf("no plans")
+	}
+
+	ids := map[string]bool{}
+	for _, p := range plans {
+		if p.ID == "" || ids[p.ID] {
+			return fmt.Errorf("invalid plan id %q", p.ID)
+		}
+
+		if !govalidator.IsUUID(p.AssetID) {
+			return fmt.Errorf("plan %s: invalid asset id", p.ID)
+		}
+
+		if !p.Amount.IsPositive() || p.Months <= 0 {
+			return fmt.Errorf("plan %s: invalid amount or months", p.ID)
+		}
+
+		ids[p.ID] = true
+	}
+
+	return nil
+}
+
+// SavePlans 把配置的套餐保存到数据库并回填版本号，内容和最新版本不同时保存为新版本，
+// 旧版本一直保留，配置删除或者修改了套餐之后，续费记录里的套餐仍然可以查到
+func SavePlans(db *badger.DB, plans []*Plan) error {
+	return db.Update(func(txn *badger.Txn) error {
+		for _, p := range plans {
+			versions, err := listPlanVersions(txn, p.ID)
+			if err != nil {
+				return err
+			}
+
+			p.Version = 1
+			if n := len(versions); n > 0 {
+				last := versions[n-1]
+				if samePlan(last, p) {
+					p.Version = last.Version
+					continue
+				}
+
+				p.Version = last.Version + 1
+			}
+
+			if err := savePlan(txn, p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func samePlan(a, b *Plan) bool {
+	return a.AssetID == b.AssetID && a.Amount.Equal(b.Amount) && a.Months == b.Months
+}
+
+func (s *Server) listPlanVersions(w http.ResponseWriter, r *http.Request) {
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	plans, err := listPlanVersions(txn, chi.URLParam(r, "id"))
+	if err != nil {
+		slog.Error("listPlanVersions", "error", err)
+		renderErr(w, err)
+		return
+	}
+
+	if len(plans) == 0 {
+		renderErr(w, twirp.NotFoundError("plan not found"))
+		return
+	}
+
+	renderJSON(w, plans)
+}
+
+func findPlan(plans []*Plan, id string) *Plan {
+	for _, p := range plans {
+		if p.ID == id {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// matchPlan 在同一资产的套餐里选出价格不超过支付金额的最贵套餐，金额不足最便宜的套餐时按它折算；
+// 金额不足所有套餐里最低的月价时时长为 0，需要退款
+func matchPlan(plans []*Plan, utxo *mixin.SafeUtxo) (*Plan, int64) {
+	var (
+		candidates []*Plan
+		minimum    decimal.Decimal
+	)
+
+	for _, p := range plans {
+		if p.AssetID != utxo.AssetID {
+			continue
+		}
+
+		if monthly := p.Amount.Div(decimal.NewFromInt(p.Months)); len(candidates) == 0 || monthly.LessThan(minimum) {
+			minimum = monthly
+		}
+
+		candidates = append(candidates, p)
+	}
+
+	if len(candidates) == 0 {
+		return nil, 0
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Amount.LessThan(candidates[j].Amount)
+	})
+
+	plan := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.Amount.GreaterThan(utxo.Amount) {
+			break
+		}
+
+		plan = p
+	}
+
+	if utxo.Amount.LessThan(minimum) {
+		return plan, 0
+	}
+
+	return plan, planPeriod(plan, utxo.Amount)
+}
+
+func planPeriod(plan *Plan, amount decimal.Decimal) int64 {
+	base := decimal.NewFromFloat(month.Seconds()).Mul(decimal.NewFromInt(plan.Months))
+	return amount.Div(plan.Amount).Mul(base).IntPart()
+}
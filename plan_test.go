@@ -0,0 +1,90 @@
+package cowallet
+
+import (
+	"testing"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/shopspring/decimal"
+)
+
+func TestMatchPlan(t *testing.T) {
+	const usdt = "4d8c508b-91c5-375b-92b0-ee702ed2dac5"
+	plans := []*Plan{
+		{ID: "yearly", AssetID: usdt, Amount: decimal.NewFromInt(100), Months: 12},
+		{ID: "monthly", AssetID: usdt, Amount: decimal.NewFromInt(10), Months: 1},
+	}
+
+	if err := ValidatePlans(plans); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		amount int64
+		plan   string
+		months float64
+	}{
+		{5, "monthly", 0}, // 不足最低的月价（年付每月约 8.33）
+		{9, "monthly", 0.9},
+		{20, "monthly", 2},
+		{100, "yearly", 12},
+		{150, "yearly", 18},
+	}
+
+	for _, c := range cases {
+		plan, period := matchPlan(plans, &mixin.SafeUtxo{
+			AssetID: usdt,
+			Amount:  decimal.NewFromInt(c.amount),
+		})
+
+		if plan.ID != c.plan {
+			t.Errorf("amount %d: want plan %s, got %s", c.amount, c.plan, plan.ID)
+		}
+
+		if want := int64(c.months * month.Seconds()); period != want {
+			t.Errorf("amount %d: want period %d, got %d", c.amount, want, period)
+		}
+	}
+
+	if plan, period := matchPlan(plans, &mixin.SafeUtxo{AssetID: "c6d0c728-2624-429b-8e0d-d9d19b6592fa"}); plan != nil || period != 0 {
+		t.Errorf("unexpected plan for unknown asset")
+	}
+}
+
+func TestSavePlans(t *testing.T) {
+	db := newTestDB(t)
+
+	const usdt = "4d8c508b-91c5-375b-92b0-ee702ed2dac5"
+	monthly := func(amount int64) []*Plan {
+		return []*Plan{{ID: "monthly", AssetID: usdt, Amount: decimal.NewFromInt(amount), Months: 1}}
+	}
+
+	for _, c := range []struct {
+		plans   []*Plan
+		version int64
+	}{
+		{monthly(10), 1},
+		{monthly(10), 1}, // 内容没有变化时沿用版本
+		{monthly(12), 2},
+	} {
+		if err := SavePlans(db, c.plans); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := c.plans[0].Version; v != c.version {
+			t.Fatalf("want version %d, got %d", c.version, v)
+		}
+	}
+
+	// 配置修改之后旧版本仍然可以查到
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	p, err := findPlanVersion(txn, "monthly", 1)
+	if err != nil || !p.Amount.Equal(decimal.NewFromInt(10)) {
+		t.Fatalf("want version 1 with amount 10, got %+v, %v", p, err)
+	}
+
+	if versions, err := listPlanVersions(txn, "monthly"); err != nil || len(versions) != 2 {
+		t.Fatalf("want 2 versions, got %d, %v", len(versions), err)
+	}
+}
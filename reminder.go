@@ -0,0 +1,98 @@
+package cowallet
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultReminders 到期前 7、3、1 天以及到期时提醒
+var DefaultReminders = []time.Duration{
+	7 * 24 * time.Hour,
+	3 * 24 * time.Hour,
+	24 * time.Hour,
+	0,
+}
+
+// 已经过期太久的 vault 不再提醒
+const reminderGracePeriod = 24 * time.Hour
+
+func (s *Server) LoopReminders(ctx context.Context) error {
+	for {
+		_ = s.loopReminders(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func (s *Server) loopReminders(_ context.Context) error {
+	txn := s.db.NewTransaction(false)
+	vaults, err := listAllVaults(txn)
+	txn.Discard()
+
+	if err != nil {
+		slog.Error("listAllVaults", "err", err)
+		return err
+	}
+
+	now := time.Now()
+	for _, vault := range vaults {
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			return remindVault(txn, vault, s.cfg.Reminders, now)
+		}); err != nil {
+			slog.Error("remindVault", "err", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remindVault 只发送离到期时间最近的一个提醒，同一个续费周期内每个提醒点只发一次
+func remindVault(txn *badger.Txn, vault *Vault, reminders []time.Duration, now time.Time) error {
+	expiredAt, _, err := getVaultExpiredAt(txn, vault.Members, vault.Threshold)
+	if err != nil {
+		return err
+	}
+
+	if expiredAt.IsZero() || now.After(expiredAt.Add(reminderGracePeriod)) {
+		return nil
+	}
+
+	reminders = slices.Clone(reminders)
+	slices.Sort(reminders)
+
+	idx := slices.IndexFunc(reminders, func(offset time.Duration) bool {
+		return !now.Before(expiredAt.Add(-offset))
+	})
+
+	if idx < 0 {
+		return nil
+	}
+
+	sent, err := hasReminder(txn, vault.Members, vault.Threshold, expiredAt, reminders[idx])
+	if err != nil || sent {
+		return err
+	}
+
+	// 更早的提醒点已经错过，一起标记为已发送
+	for _, offset := range reminders[idx:] {
+		if err := saveReminder(txn, vault.Members, vault.Threshold, expiredAt, offset); err != nil {
+			return err
+		}
+	}
+
+	return enqueueNotification(txn, &Notification{
+		Type:      NotificationExpiry,
+		Members:   vault.Members,
+		Threshold: vault.Threshold,
+		Until:     expiredAt,
+	})
+}
@@ -0,0 +1,68 @@
+package cowallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+func TestRemindVault(t *testing.T) {
+	db := newTestDB(t)
+
+	vault := &Vault{
+		Members:   []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"},
+		Threshold: 1,
+	}
+
+	now := time.Now()
+	expiredAt := now.Add(2 * 24 * time.Hour)
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveRenew(txn, &Renew{
+			ID:        uuid.New(),
+			Sequence:  1,
+			CreatedAt: now.Add(-time.Hour),
+			Members:   vault.Members,
+			Threshold: vault.Threshold,
+			From:      now.Add(-time.Hour),
+			To:        expiredAt,
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	countNotifications := func() int {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		notifications, err := listNotifications(txn, time.Now(), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(notifications)
+	}
+
+	for i, c := range []struct {
+		at   time.Time
+		want int
+	}{
+		{now, 1},                      // 3 days reminder, 7 days skipped
+		{now.Add(time.Hour), 1},       // already sent
+		{now.Add(36 * time.Hour), 2},  // 1 day reminder
+		{expiredAt.Add(time.Hour), 3}, // expired
+		{expiredAt.Add(48 * time.Hour), 3},
+	} {
+		if err := db.Update(func(txn *badger.Txn) error {
+			return remindVault(txn, vault, DefaultReminders, c.at)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := countNotifications(); got != c.want {
+			t.Fatalf("case %d: want %d notifications, got %d", i, c.want, got)
+		}
+	}
+}
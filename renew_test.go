@@ -0,0 +1,102 @@
+package cowallet
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+func TestListRenews(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		alice     = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+		members   = []string{alice}
+		threshold = uint8(1)
+		now       = time.Now().Truncate(time.Second)
+	)
+
+	// 中间三条记录时间相同
+	times := []time.Time{now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Hour)}
+	if err := db.Update(func(txn *badger.Txn) error {
+		for i, ts := range times {
+			if err := saveRenew(txn, &Renew{
+				ID:        uuid.New(),
+				Sequence:  uint64(i),
+				CreatedAt: ts,
+				Members:   members,
+				Threshold: threshold,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{db: db}
+	addr := mixin.RequireNewMixAddress(members, threshold).String()
+
+	var (
+		all   []*Renew
+		query = "limit=2"
+	)
+
+	for i := 0; i < len(times); i++ {
+		w := serveAs(s.listRenewals, "/vaults/{addr}/renewals", alice, "/vaults/"+addr+"/renewals?"+query)
+		var page []*Renew
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatalf("decode page: %v, %s", err, w.Body)
+		}
+
+		if len(page) == 0 {
+			break
+		}
+
+		all = append(all, page...)
+		last := page[len(page)-1]
+		query = "limit=2&offset=" + url.QueryEscape(last.CreatedAt.Format(time.RFC3339Nano)) + "&offset_id=" + last.ID.String()
+	}
+
+	if len(all) != len(times) {
+		t.Fatalf("want %d renewals, got %d", len(times), len(all))
+	}
+
+	seen := map[uuid.UUID]bool{}
+	for i, r := range all {
+		if seen[r.ID] {
+			t.Fatalf("renewal %s listed twice", r.ID)
+		}
+
+		seen[r.ID] = true
+
+		if i > 0 && r.CreatedAt.After(all[i-1].CreatedAt) {
+			t.Fatalf("renewals not in reverse time order at %d", i)
+		}
+	}
+
+	// 不带 offset_id 时不包含 offset 这一时刻的记录
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	if list, err := listRenews(txn, members, threshold, times[1], uuid.Nil, 10); err != nil || len(list) != 1 || list[0].Sequence != 0 {
+		t.Fatalf("want only the earliest renewal, got %d, %v", len(list), err)
+	}
+
+	// 只有 vault 成员可以查看
+	if w := serveAs(s.listRenewals, "/vaults/{addr}/renewals", "8017d200-7870-4b82-b53f-74bae1d2dad7", "/vaults/"+addr+"/renewals"); w.Code != http.StatusForbidden {
+		t.Fatalf("want forbidden, got %d", w.Code)
+	}
+
+	if w := serveAs(s.listRenewals, "/vaults/{addr}/renewals", alice, "/vaults/"+addr+"/renewals?offset_id=invalid"); w.Code != http.StatusBadRequest {
+		t.Fatalf("want bad request, got %d", w.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/fox-one/mixin-sdk-go/v2/mixinnet"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// 单笔交易最多可以使用的 utxo 数量
+	maxTransactionInputs = 255
+	maxMemoLength        = 200
+	// access token 创建多签请求需要读取 vault 的 utxo
+	multisigRequestScope = "SNAPSHOTS:READ"
+)
+
+var (
+	errInsufficientBalance = errors.New("insufficient balance")
+	errTooManyUtxos        = errors.New("too many utxos")
+)
+
+// multisigClient 创建多签请求需要的 Mixin 接口
+type multisigClient interface {
+	SafeListUtxos(ctx context.Context, opt mixin.SafeListUtxoOption) ([]*mixin.SafeUtxo, error)
+	MakeTransaction(ctx context.Context, b *mixin.SafeTransactionBuilder, outputs []*mixin.TransactionOutput) (*mixinnet.Transaction, error)
+	SafeCreateMultisigRequests(ctx context.Context, inputs []*mixin.SafeTransactionRequestInput) ([]*mixin.SafeMultisigRequest, error)
+}
+
+type TransferInput struct {
+	RequestID string
+	Members   []string
+	Threshold uint8
+	AssetID   string
+	Amount    decimal.Decimal
+	Receiver  *mixin.MixAddress
+	Memo      string
+}
+
+// selectUtxos 按 sequence 顺序选取足够支付 amount 的未花费 utxo
+func selectUtxos(ctx context.Context, client multisigClient, input *TransferInput) ([]*mixin.SafeUtxo, decimal.Decimal, error) {
+	var (
+		utxos  []*mixin.SafeUtxo
+		total  decimal.Decimal
+		offset uint64
+	)
+
+	for total.LessThan(input.Amount) {
+		const limit = 500
+		outputs, err := client.SafeListUtxos(ctx, mixin.SafeListUtxoOption{
+			Members:   input.Members,
+			Threshold: input.Threshold,
+			Asset:     input.AssetID,
+			State:     mixin.SafeUtxoStateUnspent,
+			Offset:    offset,
+			Limit:     limit,
+		})
+
+		if err != nil {
+			return nil, decimal.Zero, fmt.Errorf("list utxos failed: %w", err)
+		}
+
+		for _, output := range outputs {
+			offset = output.Sequence + 1
+			if output.State != mixin.SafeUtxoStateUnspent {
+				continue
+			}
+
+			utxos = append(utxos, output)
+			total = total.Add(output.Amount)
+			if total.GreaterThanOrEqual(input.Amount) {
+				break
+			}
+		}
+
+		if len(outputs) < limit {
+			break
+		}
+	}
+
+	if total.LessThan(input.Amount) {
+		return nil, decimal.Zero, fmt.Errorf("%w: want %s but got %s", errInsufficientBalance, input.Amount, total)
+	}
+
+	if len(utxos) > maxTransactionInputs {
+		return nil, decimal.Zero, fmt.Errorf("%w: %d", errTooManyUtxos, len(utxos))
+	}
+
+	return utxos, total, nil
+}
+
+// createMultisigRequest 用 vault 的 utxo 构建转账交易，并创建多签请求等待成员签名
+func createMultisigRequest(ctx context.Context, client multisigClient, input *TransferInput) (*mixin.SafeMultisigRequest, error) {
+	utxos, total, err := selectUtxos(ctx, client, input)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := []*mixin.TransactionOutput{
+		{
+			Address: input.Receiver,
+			Amount:  input.Amount,
+		},
+	}
+
+	// 找零回到 vault
+	if change := total.Sub(input.Amount); change.IsPositive() {
+		outputs = append(outputs, &mixin.TransactionOutput{
+			Address: mixin.RequireNewMixAddress(input.Members, input.Threshold),
+			Amount:  change,
+		})
+	}
+
+	b := mixin.NewSafeTransactionBuilder(utxos)
+	b.Hint = input.RequestID
+	b.Memo = input.Memo
+
+	tx, err := client.MakeTransaction(ctx, b, outputs)
+	if err != nil {
+		return nil, fmt.Errorf("make transaction failed: %w", err)
+	}
+
+	raw, err := tx.Dump()
+	if err != nil {
+		return nil, fmt.Errorf("tx dump failed: %w", err)
+	}
+
+	reqs, err := client.SafeCreateMultisigRequests(ctx, []*mixin.SafeTransactionRequestInput{
+		{
+			RequestID:      input.RequestID,
+			RawTransaction: raw,
+		},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("create multisig request failed: %w", err)
+	}
+
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("create multisig request failed: empty response")
+	}
+
+	return reqs[0], nil
+}
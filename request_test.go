@@ -0,0 +1,270 @@
+package cowallet
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/fox-one/mixin-sdk-go/v2/mixinnet"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/twitchtv/twirp"
+)
+
+type fakeMultisigClient struct {
+	utxos   []*mixin.SafeUtxo
+	outputs []*mixin.TransactionOutput
+	inputs  []*mixin.SafeTransactionRequestInput
+}
+
+func (c *fakeMultisigClient) SafeListUtxos(_ context.Context, opt mixin.SafeListUtxoOption) ([]*mixin.SafeUtxo, error) {
+	var list []*mixin.SafeUtxo
+	for _, u := range c.utxos {
+		if u.Sequence >= opt.Offset && len(list) < opt.Limit {
+			list = append(list, u)
+		}
+	}
+
+	return list, nil
+}
+
+func (c *fakeMultisigClient) MakeTransaction(_ context.Context, _ *mixin.SafeTransactionBuilder, outputs []*mixin.TransactionOutput) (*mixinnet.Transaction, error) {
+	c.outputs = outputs
+	return &mixinnet.Transaction{}, nil
+}
+
+func (c *fakeMultisigClient) SafeCreateMultisigRequests(_ context.Context, inputs []*mixin.SafeTransactionRequestInput) ([]*mixin.SafeMultisigRequest, error) {
+	c.inputs = inputs
+	return []*mixin.SafeMultisigRequest{{RequestID: inputs[0].RequestID}}, nil
+}
+
+func TestCreateMultisigRequest(t *testing.T) {
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d", "a0b8d5ee-7f12-4c63-9f6e-1a8c3d1e2b4f"}
+		threshold = uint8(2)
+		receiver  = mixin.RequireNewMixAddress([]string{"2f7a1a3c-5e5b-4ab2-9b8f-0c9e3f6f1d2a"}, 1)
+	)
+
+	client := &fakeMultisigClient{
+		utxos: []*mixin.SafeUtxo{
+			{Sequence: 1, Amount: decimal.NewFromInt(3), State: mixin.SafeUtxoStateUnspent},
+			{Sequence: 2, Amount: decimal.NewFromInt(5), State: mixin.SafeUtxoStateSigned},
+			{Sequence: 3, Amount: decimal.NewFromInt(4), State: mixin.SafeUtxoStateUnspent},
+			{Sequence: 4, Amount: decimal.NewFromInt(9), State: mixin.SafeUtxoStateUnspent},
+		},
+	}
+
+	input := &TransferInput{
+		RequestID: uuid.NewString(),
+		Members:   members,
+		Threshold: threshold,
+		AssetID:   "965e5c6e-434c-3fa9-b780-c50f43cd955c",
+		Amount:    decimal.NewFromInt(6),
+		Receiver:  receiver,
+	}
+
+	// 跳过已经签名的 utxo，够用之后不再继续选取
+	utxos, total, err := selectUtxos(context.Background(), client, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(utxos) != 2 || utxos[0].Sequence != 1 || utxos[1].Sequence != 3 || !total.Equal(decimal.NewFromInt(7)) {
+		t.Fatalf("unexpected utxos %d, total %s", len(utxos), total)
+	}
+
+	req, err := createMultisigRequest(context.Background(), client, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.RequestID != input.RequestID || client.inputs[0].RequestID != input.RequestID {
+		t.Fatalf("unexpected request id %s", req.RequestID)
+	}
+
+	// 找零回到 vault
+	if len(client.outputs) != 2 ||
+		client.outputs[0].Address.String() != receiver.String() || !client.outputs[0].Amount.Equal(input.Amount) ||
+		client.outputs[1].Address.String() != mixin.RequireNewMixAddress(members, threshold).String() || !client.outputs[1].Amount.Equal(decimal.NewFromInt(1)) {
+		t.Fatalf("unexpected outputs %+v", client.outputs)
+	}
+
+	input.Amount = decimal.NewFromInt(100)
+	if _, err := createMultisigRequest(context.Background(), client, input); !errors.Is(err, errInsufficientBalance) {
+		t.Fatalf("want insufficient balance, got %v", err)
+	}
+
+	if terr, ok := createRequestErr(errors.New("mixin: internal server error")).(twirp.Error); !ok || terr.Msg() != "create request failed" {
+		t.Fatalf("internal errors should not be exposed, got %v", terr)
+	}
+}
+
+func TestMultisigRequestLifecycle(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		alice     = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+		bob       = "8017d200-7870-4b82-b53f-74bae1d2dad7"
+		members   = []string{alice, bob}
+		threshold = uint8(2)
+		now       = time.Now()
+	)
+
+	req := &mixin.SafeMultisigRequest{
+		RequestID: uuid.NewString(),
+		AssetID:   "965e5c6e-434c-3fa9-b780-c50f43cd955c",
+		Amount:    decimal.NewFromInt(1),
+		Signers:   []string{alice},
+		Extra:     hex.EncodeToString([]byte("rent")),
+		CreatedAt: now.Add(-time.Minute),
+		Receivers: []*mixin.SafeMultisigReceiver{
+			{Members: []string{"2f7a1a3c-5e5b-4ab2-9b8f-0c9e3f6f1d2a"}, Threshold: 1},
+		},
+	}
+
+	save := func(r *MultisigRequest) {
+		if err := db.Update(func(txn *badger.Txn) error {
+			return saveMultisigRequest(txn, r)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open := func() []*MultisigRequest {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		requests, err := listOpenMultisigRequests(txn, members, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return requests
+	}
+
+	// 只有 alice 签名
+	r := requestToMultisigRequest(req, members, threshold, MultisigRequestStateInitial)
+	if r.Memo != "rent" || len(r.Receivers) != 1 || len(r.Missing) != 1 || r.Missing[0] != bob {
+		t.Fatalf("unexpected request %+v", r)
+	}
+
+	save(r)
+	if got := open(); len(got) != 1 || got[0].State != MultisigRequestStateInitial {
+		t.Fatalf("want 1 open initial request, got %d", len(got))
+	}
+
+	// 签名足够之后仍然是未完成的请求
+	req.Signers = []string{alice, bob}
+	r = requestToMultisigRequest(req, members, threshold, MultisigRequestStateSigned)
+	if len(r.Missing) != 0 {
+		t.Fatalf("want no missing signers, got %v", r.Missing)
+	}
+
+	save(r)
+	if got := open(); len(got) != 1 || got[0].State != MultisigRequestStateSigned {
+		t.Fatalf("want 1 open signed request, got %d", len(got))
+	}
+
+	// 花费之后不再是未完成的请求
+	save(requestToMultisigRequest(req, members, threshold, MultisigRequestStateSpent))
+	if got := open(); len(got) != 0 {
+		t.Fatalf("want no open requests, got %d", len(got))
+	}
+
+	// 另一个请求被解锁
+	unlocked := requestToMultisigRequest(&mixin.SafeMultisigRequest{
+		RequestID: uuid.NewString(),
+		CreatedAt: now,
+	}, members, threshold, MultisigRequestStateUnlocked)
+	save(unlocked)
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	list, err := listMultisigRequests(txn, members, threshold, time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 || list[0].ID != unlocked.ID || list[1].ID != r.ID || list[1].State != MultisigRequestStateSpent {
+		t.Fatalf("unexpected requests %+v", list)
+	}
+
+	if page, err := listMultisigRequests(txn, members, threshold, unlocked.CreatedAt, 10); err != nil || len(page) != 1 || page[0].ID != r.ID {
+		t.Fatalf("want the older request after offset, got %d, %v", len(page), err)
+	}
+
+	// 刚创建、还没有人签名的请求也是未完成的请求
+	created := requestToMultisigRequest(&mixin.SafeMultisigRequest{
+		RequestID: uuid.NewString(),
+		CreatedAt: now,
+	}, members, threshold, MultisigRequestStateInitial)
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return applyMultisigRequest(txn, created, false)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := open(); len(got) != 1 || got[0].ID != created.ID || len(got[0].Missing) != len(members) {
+		t.Fatalf("want the created request open, got %d", len(got))
+	}
+}
+
+func TestRequestHandlers(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		alice     = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+		members   = []string{alice}
+		threshold = uint8(1)
+		other     = mixin.RequireNewMixAddress([]string{"8017d200-7870-4b82-b53f-74bae1d2dad7"}, 1)
+	)
+
+	r := &MultisigRequest{
+		ID:        uuid.New(),
+		Members:   members,
+		Threshold: threshold,
+		State:     MultisigRequestStateInitial,
+		CreatedAt: time.Now(),
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveMultisigRequest(txn, r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{db: db}
+	addr := mixin.RequireNewMixAddress(members, threshold).String()
+
+	w := serveAs(s.listRequests, "/vaults/{addr}/requests", alice, "/vaults/"+addr+"/requests")
+	var list []*MultisigRequest
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list) != 1 || list[0].ID != r.ID {
+		t.Fatalf("unexpected list %d %s", w.Code, w.Body)
+	}
+
+	for _, c := range []struct {
+		user   string
+		target string
+		code   int
+	}{
+		{alice, "/vaults/" + addr + "/requests/" + r.ID.String(), http.StatusOK},
+		{alice, "/vaults/" + addr + "/requests/" + uuid.NewString(), http.StatusNotFound},
+		{alice, "/vaults/" + addr + "/requests/invalid", http.StatusBadRequest},
+		// 不是 vault 成员
+		{"8017d200-7870-4b82-b53f-74bae1d2dad7", "/vaults/" + addr + "/requests/" + r.ID.String(), http.StatusForbidden},
+		// 其他 vault 的成员查不到这个请求
+		{other.Members()[0], "/vaults/" + other.String() + "/requests/" + r.ID.String(), http.StatusNotFound},
+	} {
+		if w := serveAs(s.findRequest, "/vaults/{addr}/requests/{id}", c.user, c.target); w.Code != c.code {
+			t.Errorf("%s: want status %d, got %d", c.target, c.code, w.Code)
+		}
+	}
+}
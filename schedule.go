@@ -0,0 +1,58 @@
+package cowallet
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	syncActiveInterval = 5 * time.Second  // 有新的 utxo 或者未完成的多签请求
+	syncRecentInterval = 30 * time.Second // 最近一小时有过变动
+	syncIdleInterval   = 2 * time.Minute
+	syncMaxBackoff     = 10 * time.Minute
+)
+
+// DefaultSyncConcurrency 同时同步的 vault 数量，也就是同时调用 Mixin API 的上限
+const DefaultSyncConcurrency = 10
+
+func withJitter(d time.Duration) time.Duration {
+	if n := int64(d) / 5; n > 0 {
+		d += time.Duration(rand.Int63n(2*n) - n)
+	}
+
+	return d
+}
+
+// scheduleNextRun 根据这次同步的结果决定下次同步的时间，失败时指数退避
+func scheduleNextRun(v *Schedule, now time.Time, active bool, err error) {
+	v.LastRunAt = now
+
+	if err != nil {
+		v.Failures++
+		v.LastError = err.Error()
+
+		backoff := syncMaxBackoff
+		if v.Failures < 10 {
+			backoff = min(syncActiveInterval<<v.Failures, syncMaxBackoff)
+		}
+
+		v.NextRunAt = now.Add(withJitter(backoff))
+		return
+	}
+
+	v.Failures = 0
+	v.LastError = ""
+
+	if active {
+		v.LastActivityAt = now
+	}
+
+	interval := syncIdleInterval
+	if active {
+		interval = syncActiveInterval
+	} else if now.Sub(v.LastActivityAt) < time.Hour {
+		interval = syncRecentInterval
+	}
+
+	v.NextRunAt = now.Add(withJitter(interval))
+}
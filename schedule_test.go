@@ -0,0 +1,70 @@
+package cowallet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleNextRun(t *testing.T) {
+	now := time.Now()
+	within := func(d, want time.Duration) bool {
+		return d >= want*4/5 && d <= want*6/5
+	}
+
+	v := &Schedule{}
+	scheduleNextRun(v, now, true, nil)
+	if d := v.NextRunAt.Sub(now); !within(d, syncActiveInterval) {
+		t.Errorf("active: unexpected interval %s", d)
+	}
+
+	scheduleNextRun(v, now.Add(time.Minute), false, nil)
+	if d := v.NextRunAt.Sub(now.Add(time.Minute)); !within(d, syncRecentInterval) {
+		t.Errorf("recent: unexpected interval %s", d)
+	}
+
+	later := now.Add(2 * time.Hour)
+	scheduleNextRun(v, later, false, nil)
+	if d := v.NextRunAt.Sub(later); !within(d, syncIdleInterval) {
+		t.Errorf("idle: unexpected interval %s", d)
+	}
+
+	for i := 1; i <= 20; i++ {
+		scheduleNextRun(v, later, false, errors.New("boom"))
+		want := syncMaxBackoff
+		if i < 10 {
+			want = min(syncActiveInterval<<i, syncMaxBackoff)
+		}
+
+		if d := v.NextRunAt.Sub(later); !within(d, want) {
+			t.Errorf("failure %d: unexpected backoff %s", i, d)
+		}
+	}
+
+	if v.Failures != 20 || v.LastError != "boom" {
+		t.Errorf("unexpected failure state %+v", v)
+	}
+}
+
+func TestRunJobWithoutCredential(t *testing.T) {
+	db := newTestDB(t)
+	s := newTestServer(t, db, Config{Secret: []byte("secret")})
+
+	members := []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+	job := &Job{User: &User{MixinID: members[0]}, Members: members, Threshold: 1}
+
+	schedule, err := FindSchedule(db, members, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.runJob(context.Background(), job, schedule); !errors.Is(err, errNoCredential) {
+		t.Fatalf("want errNoCredential, got %v", err)
+	}
+
+	// 没有保存 access token 时在同步计划里标记出来
+	if v, err := FindSchedule(db, members, 1); err != nil || !v.CredentialMissing || v.LastError != errNoCredential.Error() {
+		t.Fatalf("unexpected schedule %+v, %v", v, err)
+	}
+}
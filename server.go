@@ -2,43 +2,126 @@ package cowallet
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/fox-one/mixin-sdk-go/v2"
 	"github.com/fox-one/mixin-sdk-go/v2/mixinnet"
-	"github.com/shopspring/decimal"
 	"github.com/yiplee/go-cache"
 	"golang.org/x/sync/errgroup"
 )
 
 type Config struct {
-	SpendKey   mixinnet.Key
-	PayAssetID string
-	PayAmount  decimal.Decimal
+	SpendKey  mixinnet.Key
+	Plans     []*Plan
+	Notifier  Notifier        // 默认通过机器人发送 Mixin 消息
+	Reminders []time.Duration // 到期前多久发送提醒，默认为 DefaultReminders
+	Secret    []byte          // 签发 session 和加密 credential，默认由 SpendKey 推导
+	Currency  string          // 默认的展示法币，默认为 USD
+	Rates     FiatRates       // 法币汇率，为空时使用数据库里保存的汇率
+	Admins    []string        // 允许访问 /admin 的 Mixin ID
+
+	BackupDir      string        // 定期备份的目录，为空时不备份
+	BackupInterval time.Duration // 备份间隔，默认为 DefaultBackupInterval
+	BackupKeep     int           // 保留的全量备份数量，默认为 DefaultBackupKeep
+
+	SyncConcurrency int // 同时同步的 vault 数量，默认为 DefaultSyncConcurrency
 }
 
 type Server struct {
-	db     *badger.DB
-	client *mixin.Client
-	cfg    Config
+	db       *badger.DB
+	client   *mixin.Client
+	payments paymentClient // 续费和退款交易，测试时替换
+	cfg      Config
 
-	assets *cache.Cache[string, *mixin.SafeAsset]
+	assets   *cache.Cache[string, *mixin.SafeAsset]
+	webhooks *http.Client
+	notifier Notifier
+	secret   []byte
+	events   *eventHub
 }
 
 func NewServer(
 	db *badger.DB,
 	client *mixin.Client,
 	cfg Config,
-) Server {
+) (Server, error) {
+	// getSystemInfo 和 createInvoice 使用第一个套餐作为默认套餐
+	if err := ValidatePlans(cfg.Plans); err != nil {
+		return Server{}, fmt.Errorf("invalid plans: %w", err)
+	}
+
+	notifier := cfg.Notifier
+	if notifier == nil {
+		notifier = NewMixinNotifier(client)
+	}
+
+	if len(cfg.Reminders) == 0 {
+		cfg.Reminders = DefaultReminders
+	}
+
+	if cfg.Currency == "" {
+		cfg.Currency = DefaultCurrency
+	}
+
+	if cfg.BackupInterval <= 0 {
+		cfg.BackupInterval = DefaultBackupInterval
+	}
+
+	if cfg.BackupKeep <= 0 {
+		cfg.BackupKeep = DefaultBackupKeep
+	}
+
+	if cfg.SyncConcurrency <= 0 {
+		cfg.SyncConcurrency = DefaultSyncConcurrency
+	}
+
+	secret := cfg.Secret
+	if len(secret) == 0 {
+		secret = deriveKey([]byte(cfg.SpendKey.String()), "cowallet")
+	}
+
 	return Server{
-		db:     db,
-		client: client,
-		cfg:    cfg,
-		assets: cache.New[string, *mixin.SafeAsset](),
+		db:       db,
+		client:   client,
+		payments: client,
+		cfg:      cfg,
+		assets:   cache.New[string, *mixin.SafeAsset](),
+		webhooks: newWebhookClient(),
+		notifier: notifier,
+		secret:   secret,
+		events:   newEventHub(),
+	}, nil
+}
+
+// Prepare 保存套餐和汇率并执行 migration，必须在提供 HTTP 服务和 Run 之前完成
+func (s *Server) Prepare(ctx context.Context) error {
+	if err := SavePlans(s.db, s.cfg.Plans); err != nil {
+		return err
 	}
+
+	if len(s.cfg.Rates) > 0 {
+		if err := SaveProperty(s.db, fiatRatesProperty, s.cfg.Rates); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.displayCurrency(""); err != nil {
+		return fmt.Errorf("no rate for currency %s: %w", s.cfg.Currency, err)
+	}
+
+	if _, err := Migrate(ctx, s.db, false); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
+	instrumentMixin()
+
 	var g errgroup.Group
 
 	g.Go(func() error {
@@ -49,5 +132,21 @@ func (s *Server) Run(ctx context.Context) error {
 		return s.HandlePendingJobs(ctx)
 	})
 
+	g.Go(func() error {
+		return s.LoopWebhooks(ctx)
+	})
+
+	g.Go(func() error {
+		return s.LoopNotifications(ctx)
+	})
+
+	g.Go(func() error {
+		return s.LoopReminders(ctx)
+	})
+
+	g.Go(func() error {
+		return s.LoopBackups(ctx)
+	})
+
 	return g.Wait()
 }
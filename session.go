@@ -0,0 +1,319 @@
+package cowallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	sessionTokenPrefix = "cw."
+	accessTokenTTL     = time.Hour
+	refreshTokenTTL    = 30 * 24 * time.Hour
+)
+
+var (
+	errInvalidSession = errors.New("invalid session")
+	// errKeystoreLogin keystore 不能派生出可以单独保存的 token，后台同步需要 access token
+	errKeystoreLogin = errors.New("keystore login is not supported, sign in with a Mixin OAuth access token")
+	// errNoCredential 没有保存成员的 access token，需要有成员重新登录后才能继续同步
+	errNoCredential      = errors.New("no sync credential, a member needs to sign in with a Mixin OAuth access token")
+	errCredentialExpired = errors.New("sync credential expired, a member needs to sign in with a Mixin OAuth access token")
+)
+
+type sessionClaims struct {
+	SessionID uuid.UUID `json:"sid"`
+	UserID    string    `json:"uid"`
+	ExpiredAt int64     `json:"exp"`
+}
+
+type SessionToken struct {
+	UserID       string    `json:"user_id"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiredAt    time.Time `json:"expired_at"`
+}
+
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func isSessionToken(token string) bool {
+	return strings.HasPrefix(token, sessionTokenPrefix)
+}
+
+func (s *Server) signAccessToken(c *sessionClaims) string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, deriveKey(s.secret, "session"))
+	mac.Write([]byte(payload))
+	return sessionTokenPrefix + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAccessToken 校验签名和有效期，并确认 session 没有被注销
+func (s *Server) verifyAccessToken(txn *badger.Txn, token string) (*User, error) {
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, sessionTokenPrefix), ".")
+	if !ok {
+		return nil, errInvalidSession
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(s.secret, "session"))
+	mac.Write([]byte(payload))
+	if want, err := base64.RawURLEncoding.DecodeString(sig); err != nil || !hmac.Equal(want, mac.Sum(nil)) {
+		return nil, errInvalidSession
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidSession
+	}
+
+	var c sessionClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errInvalidSession
+	}
+
+	if time.Now().Unix() >= c.ExpiredAt {
+		return nil, errInvalidSession
+	}
+
+	session, err := findSession(txn, c.SessionID)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, errInvalidSession
+		}
+
+		return nil, err
+	}
+
+	if session.RevokedAt != nil || session.UserID != c.UserID {
+		return nil, errInvalidSession
+	}
+
+	return &User{MixinID: c.UserID}, nil
+}
+
+func hashRefreshToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// issueSession 签发 access token，refresh token 只保存哈希，每次刷新都会轮换
+func (s *Server) issueSession(txn *badger.Txn, session *Session) (*SessionToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	now := time.Now()
+	refresh := hex.EncodeToString(secret)
+	session.RefreshHash = hashRefreshToken(refresh)
+	session.ExpiredAt = now.Add(refreshTokenTTL)
+
+	if err := saveSession(txn, session); err != nil {
+		return nil, err
+	}
+
+	expiredAt := now.Add(accessTokenTTL)
+	return &SessionToken{
+		UserID: session.UserID,
+		AccessToken: s.signAccessToken(&sessionClaims{
+			SessionID: session.ID,
+			UserID:    session.UserID,
+			ExpiredAt: expiredAt.Unix(),
+		}),
+		RefreshToken: session.ID.String() + "." + refresh,
+		ExpiredAt:    expiredAt,
+	}, nil
+}
+
+func (s *Server) refreshSession(txn *badger.Txn, token string) (*SessionToken, error) {
+	id, refresh, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidSession
+	}
+
+	sid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, errInvalidSession
+	}
+
+	session, err := findSession(txn, sid)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, errInvalidSession
+		}
+
+		return nil, err
+	}
+
+	if session.RevokedAt != nil || !hmac.Equal([]byte(session.RefreshHash), []byte(hashRefreshToken(refresh))) {
+		return nil, errInvalidSession
+	}
+
+	return s.issueSession(txn, session)
+}
+
+func revokeSession(txn *badger.Txn, token string) error {
+	payload, _, _ := strings.Cut(strings.TrimPrefix(token, sessionTokenPrefix), ".")
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errInvalidSession
+	}
+
+	var c sessionClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return errInvalidSession
+	}
+
+	session, err := findSession(txn, c.SessionID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session.RevokedAt = &now
+	return saveSession(txn, session)
+}
+
+func (s *Server) sealCredential(token string) (string, error) {
+	block, err := aes.NewCipher(deriveKey(s.secret, "credential"))
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(token), nil)), nil
+}
+
+func (s *Server) openCredential(sealed string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(deriveKey(s.secret, "credential"))
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid credential")
+	}
+
+	token, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
+
+// saveUserCredential 保存用户的 access token 用于后台同步，只有过期时间更晚的 token 才会替换已保存的 token
+func (s *Server) saveUserCredential(user *User) error {
+	if !isAccessToken(user.Token) {
+		return errKeystoreLogin
+	}
+
+	expiredAt, err := accessTokenExpiredAt(user.Token)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := s.sealCredential(user.Token)
+	if err != nil {
+		return err
+	}
+
+	v := &Credential{
+		UserID:    uuid.MustParse(user.MixinID),
+		Sealed:    sealed,
+		ExpiredAt: expiredAt,
+		UpdatedAt: time.Now(),
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		old, err := findCredential(txn, v.UserID)
+		if err == nil && !old.ExpiredAt.Before(v.ExpiredAt) {
+			return nil
+		}
+
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		return saveCredential(txn, v)
+	})
+}
+
+// userToken 优先使用请求携带的 token，否则使用加密保存的 credential
+func (s *Server) userToken(user *User) (string, error) {
+	if user.Token != "" {
+		return user.Token, nil
+	}
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+
+	v, err := findCredential(txn, uuid.MustParse(user.MixinID))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return "", errNoCredential
+		}
+
+		return "", fmt.Errorf("find credential failed: %w", err)
+	}
+
+	if v.Expired() {
+		return "", errCredentialExpired
+	}
+
+	token, err := s.openCredential(v.Sealed)
+	if err != nil {
+		return "", fmt.Errorf("open credential failed: %w", err)
+	}
+
+	return token, nil
+}
+
+func (s *Server) userClient(user *User) (*mixin.Client, error) {
+	token, err := s.userToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientFromToken(token)
+}
@@ -0,0 +1,243 @@
+package cowallet
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+func TestSession(t *testing.T) {
+	db := newTestDB(t)
+
+	s := newTestServer(t, db, Config{Secret: []byte("secret")})
+	const user = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+
+	var token *SessionToken
+	if err := db.Update(func(txn *badger.Txn) error {
+		var err error
+		token, err = s.issueSession(txn, &Session{
+			ID:        uuid.New(),
+			UserID:    user,
+			CreatedAt: time.Now(),
+		})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(token string) error {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		u, err := s.verifyAccessToken(txn, token)
+		if err == nil && u.MixinID != user {
+			t.Fatalf("unexpected user %s", u.MixinID)
+		}
+
+		return err
+	}
+
+	if err := verify(token.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify(token.AccessToken + "x"); !errors.Is(err, errInvalidSession) {
+		t.Fatalf("tampered token accepted: %v", err)
+	}
+
+	var refreshed *SessionToken
+	if err := db.Update(func(txn *badger.Txn) error {
+		var err error
+		refreshed, err = s.refreshSession(txn, token.RefreshToken)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// refresh token 只能使用一次
+	if err := db.Update(func(txn *badger.Txn) error {
+		_, err := s.refreshSession(txn, token.RefreshToken)
+		return err
+	}); !errors.Is(err, errInvalidSession) {
+		t.Fatalf("refresh token reused: %v", err)
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return revokeSession(txn, refreshed.AccessToken)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify(refreshed.AccessToken); !errors.Is(err, errInvalidSession) {
+		t.Fatalf("revoked token accepted: %v", err)
+	}
+}
+
+func TestSealCredential(t *testing.T) {
+	s := newTestServer(t, nil, Config{Secret: []byte("secret")})
+
+	sealed, err := s.sealCredential("keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.openCredential(sealed)
+	if err != nil || token != "keystore" {
+		t.Fatalf("open credential: %q %v", token, err)
+	}
+}
+
+func testAccessToken(expiredAt time.Time) string {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, expiredAt.Unix())))
+	return "eyJhbGciOiJFZERTQSJ9." + claims + ".sig"
+}
+
+func TestSaveUserCredential(t *testing.T) {
+	db := newTestDB(t)
+	s := newTestServer(t, db, Config{Secret: []byte("secret")})
+
+	const user = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+	find := func() (*Credential, error) {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		return findCredential(txn, uuid.MustParse(user))
+	}
+
+	// keystore 不会保存
+	keystore := `{"client_id":"` + user + `","session_id":"x","private_key":"x"}`
+	if err := s.saveUserCredential(&User{MixinID: user, Token: keystore}); !errors.Is(err, errKeystoreLogin) {
+		t.Fatalf("want errKeystoreLogin, got %v", err)
+	}
+
+	if _, err := s.userClient(&User{MixinID: user}); !errors.Is(err, errNoCredential) {
+		t.Fatalf("want errNoCredential, got %v", err)
+	}
+
+	later := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	if err := s.saveUserCredential(&User{MixinID: user, Token: testAccessToken(later)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 更早过期的 token 不会覆盖
+	if err := s.saveUserCredential(&User{MixinID: user, Token: testAccessToken(later.Add(-time.Hour))}); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := find()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.ExpiredAt.Equal(later) {
+		t.Fatalf("want expired at %s, got %s", later, v.ExpiredAt)
+	}
+
+	if _, err := s.userClient(&User{MixinID: user}); err != nil {
+		t.Fatalf("userClient: %v", err)
+	}
+
+	// 过期的 token 不再用于同步
+	v.ExpiredAt = time.Now().Add(-time.Minute)
+	if err := db.Update(func(txn *badger.Txn) error {
+		return saveCredential(txn, v)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.userClient(&User{MixinID: user}); !errors.Is(err, errCredentialExpired) {
+		t.Fatalf("want errCredentialExpired, got %v", err)
+	}
+}
+
+func TestLogoutKeepsCredential(t *testing.T) {
+	db := newTestDB(t)
+	s := newTestServer(t, db, Config{Secret: []byte("secret")})
+	h := s.Handler()
+
+	const user = "f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"
+	if err := s.saveUserCredential(&User{MixinID: user, Token: testAccessToken(time.Now().Add(time.Hour))}); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+
+	token, err := s.issueSession(txn, &Session{ID: uuid.New(), UserID: user, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, target string) int {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// 登出只注销 session，后台同步仍然可以使用保存的 token
+	if code := do(http.MethodPost, "/auth/logout"); code != http.StatusOK {
+		t.Fatalf("logout: want 200, got %d", code)
+	}
+
+	if _, err := s.userClient(&User{MixinID: user}); err != nil {
+		t.Fatalf("credential dropped on logout: %v", err)
+	}
+
+	if code := do(http.MethodDelete, "/auth/credential"); code != http.StatusUnauthorized {
+		t.Fatalf("revoked session: want 401, got %d", code)
+	}
+
+	txn = db.NewTransaction(true)
+	defer txn.Discard()
+
+	if token, err = s.issueSession(txn, &Session{ID: uuid.New(), UserID: user, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := do(http.MethodDelete, "/auth/credential"); code != http.StatusOK {
+		t.Fatalf("revoke credential: want 200, got %d", code)
+	}
+
+	if _, err := s.userClient(&User{MixinID: user}); !errors.Is(err, errNoCredential) {
+		t.Fatalf("want errNoCredential after revoke, got %v", err)
+	}
+}
+
+func TestKeystoreLoginRejected(t *testing.T) {
+	db := newTestDB(t)
+	s := newTestServer(t, db, Config{Secret: []byte("secret")})
+	h := s.Handler()
+
+	keystore := `{"client_id":"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d","session_id":"x","private_key":"x","authorization_id":"x","scope":"PROFILE:READ"}`
+
+	r := httptest.NewRequest(http.MethodGet, "/vaults", nil)
+	r.Header.Set("Authorization", keystore)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "keystore login is not supported") {
+		t.Fatalf("keystore header: want 401, got %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(keystore)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "keystore login is not supported") {
+		t.Fatalf("keystore login: want 400, got %d %s", w.Code, w.Body)
+	}
+}
@@ -2,5 +2,5 @@ package cowallet
 
 type User struct {
 	MixinID string `json:"mixin_id"`
-	Token   string `json:"token"`
+	Token   string `json:"-"` // 不会被持久化，后台同步使用 Credential
 }
@@ -0,0 +1,107 @@
+package cowallet
+
+import (
+	"errors"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+// applyUtxo 把同步到的 utxo 合并到本地集合，utxo 状态变化后 sequence 会更新，旧的记录不会覆盖新的
+func applyUtxo(txn *badger.Txn, members []string, threshold uint8, output *mixin.SafeUtxo) error {
+	id := uuid.MustParse(output.OutputID)
+
+	old, err := findUtxo(txn, members, threshold, id)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+
+	if old != nil && old.Sequence > output.Sequence {
+		return nil
+	}
+
+	if output.State == mixin.SafeUtxoStateSpent {
+		if old == nil {
+			return nil
+		}
+
+		return deleteUtxo(txn, members, threshold, id)
+	}
+
+	return saveUtxo(txn, members, threshold, &Utxo{
+		ID:        id,
+		AssetID:   output.AssetID,
+		Hash:      output.KernelAssetID.String(),
+		Amount:    output.Amount,
+		State:     string(output.State),
+		SignedBy:  output.SignedBy,
+		Sequence:  output.Sequence,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// utxoReconcileInterval 定期从本地最早的 utxo 开始重新同步一遍，
+// utxo 状态变化时如果 sequence 没有更新，只往后同步会一直漏掉这次变化
+const utxoReconcileInterval = time.Hour
+
+// syncOffset 返回这次同步的起始位置，距离上次对账超过 utxoReconcileInterval 时
+// 从本地最早的 utxo 开始，reconcile 表示这次同步是对账
+func syncOffset(txn *badger.Txn, vault *Vault, now time.Time) (offset uint64, reconcile bool, err error) {
+	if now.Sub(vault.ReconciledAt) < utxoReconcileInterval {
+		return vault.Offset, false, nil
+	}
+
+	utxos, err := listUtxos(txn, vault.Members, vault.Threshold)
+	if err != nil {
+		return 0, false, err
+	}
+
+	offset = vault.Offset
+	for _, u := range utxos {
+		offset = min(offset, u.Sequence)
+	}
+
+	return offset, true, nil
+}
+
+// listVaultAssets 根据本地 utxo 集合计算 vault 的余额
+func listVaultAssets(txn *badger.Txn, members []string, threshold uint8) ([]*Asset, error) {
+	utxos, err := listUtxos(txn, members, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		assets  = []*Asset{}
+		indexes = map[string]int{}
+	)
+
+	for _, u := range utxos {
+		idx, ok := indexes[u.AssetID]
+		if !ok {
+			idx = len(assets)
+			indexes[u.AssetID] = idx
+			assets = append(assets, &Asset{
+				ID:   u.AssetID,
+				Hash: u.Hash,
+			})
+		}
+
+		asset := assets[idx]
+		asset.Balance = asset.Balance.Add(u.Amount)
+		switch mixin.SafeUtxoState(u.State) {
+		case mixin.SafeUtxoStateUnspent:
+			asset.Unspent = asset.Unspent.Add(u.Amount)
+		case mixin.SafeUtxoStateSigned:
+			asset.Signed = asset.Signed.Add(u.Amount)
+			if !govalidator.IsIn(u.SignedBy, asset.Requests...) {
+				asset.Requests = append(asset.Requests, u.SignedBy)
+			}
+		}
+	}
+
+	return assets, nil
+}
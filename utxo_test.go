@@ -0,0 +1,131 @@
+package cowallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestApplyUtxo(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		assetID   = "965e5c6e-434c-3fa9-b780-c50f43cd955c"
+		request   = uuid.NewString()
+	)
+
+	output := func(id string, amount string, state mixin.SafeUtxoState, seq uint64) *mixin.SafeUtxo {
+		o := &mixin.SafeUtxo{
+			OutputID: id,
+			AssetID:  assetID,
+			Amount:   decimal.RequireFromString(amount),
+			State:    state,
+			Sequence: seq,
+		}
+
+		if state != mixin.SafeUtxoStateUnspent {
+			o.SignedBy = request
+		}
+
+		return o
+	}
+
+	apply := func(outputs ...*mixin.SafeUtxo) []*Asset {
+		var assets []*Asset
+		if err := db.Update(func(txn *badger.Txn) error {
+			for _, o := range outputs {
+				if err := applyUtxo(txn, members, threshold, o); err != nil {
+					return err
+				}
+			}
+
+			var err error
+			assets, err = listVaultAssets(txn, members, threshold)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return assets
+	}
+
+	a, b := uuid.NewString(), uuid.NewString()
+
+	assets := apply(output(a, "1", mixin.SafeUtxoStateUnspent, 1), output(b, "2", mixin.SafeUtxoStateUnspent, 2))
+	if len(assets) != 1 || !assets[0].Balance.Equal(decimal.NewFromInt(3)) || !assets[0].Unspent.Equal(decimal.NewFromInt(3)) {
+		t.Fatalf("unexpected assets %+v", assets)
+	}
+
+	// a 被签名锁定，旧的 sequence 不会覆盖
+	assets = apply(output(a, "1", mixin.SafeUtxoStateSigned, 3), output(a, "1", mixin.SafeUtxoStateUnspent, 1))
+	if !assets[0].Signed.Equal(decimal.NewFromInt(1)) || len(assets[0].Requests) != 1 || assets[0].Requests[0] != request {
+		t.Fatalf("unexpected assets %+v", assets[0])
+	}
+
+	// a 被花费后从本地集合删除
+	assets = apply(output(a, "1", mixin.SafeUtxoStateSpent, 4))
+	if !assets[0].Balance.Equal(decimal.NewFromInt(2)) || !assets[0].Signed.IsZero() || len(assets[0].Requests) != 0 {
+		t.Fatalf("unexpected assets %+v", assets[0])
+	}
+
+	if assets = apply(output(b, "2", mixin.SafeUtxoStateSpent, 5)); len(assets) != 0 {
+		t.Fatalf("unexpected assets %+v", assets)
+	}
+}
+
+func TestSyncOffset(t *testing.T) {
+	db := newTestDB(t)
+
+	var (
+		members   = []string{"f25b410b-2ab3-4fb3-bd0f-1d5d280c529d"}
+		threshold = uint8(1)
+		now       = time.Now()
+		vault     = &Vault{Members: members, Threshold: threshold, Offset: 100}
+	)
+
+	offset := func() (uint64, bool) {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		v, reconcile, err := syncOffset(txn, vault, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return v, reconcile
+	}
+
+	// 本地没有 utxo 时从上次的位置开始
+	if v, reconcile := offset(); v != 100 || !reconcile {
+		t.Fatalf("want 100 with reconcile, got %d %v", v, reconcile)
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		for _, seq := range []uint64{50, 10} {
+			if err := saveUtxo(txn, members, threshold, &Utxo{ID: uuid.New(), State: string(mixin.SafeUtxoStateSigned), Sequence: seq}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 对账从本地最早的 utxo 开始，状态变化但 sequence 没有更新的 utxo 会被重新同步
+	if v, reconcile := offset(); v != 10 || !reconcile {
+		t.Fatalf("want 10 with reconcile, got %d %v", v, reconcile)
+	}
+
+	// 两次对账之间只往后同步
+	vault.ReconciledAt = now.Add(-time.Minute)
+	if v, reconcile := offset(); v != 100 || reconcile {
+		t.Fatalf("want 100 without reconcile, got %d %v", v, reconcile)
+	}
+}
@@ -0,0 +1,309 @@
+package cowallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fox-one/mixin-sdk-go/v2"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	webhookMaxAttempts = 10
+	webhookMaxBackoff  = time.Hour
+	webhookDeliveryTTL = 7 * 24 * time.Hour // 投递成功或者最终失败的记录保留的时间
+
+	WebhookSignatureHeader = "X-Cowallet-Signature"
+	WebhookTimestampHeader = "X-Cowallet-Timestamp"
+	WebhookEventHeader     = "X-Cowallet-Event"
+	WebhookDeliveryHeader  = "X-Cowallet-Delivery"
+
+	// WebhookTimestampTolerance 接收方允许的签名时间偏差，超过的请求应当拒绝，防止被截获的请求重放
+	WebhookTimestampTolerance = 5 * time.Minute
+)
+
+var errWebhookSignature = errors.New("invalid webhook signature")
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// SignWebhook 返回 timestamp + "." + body 的 HMAC-SHA256 签名，timestamp 为 X-Cowallet-Timestamp 里的 unix 秒数，
+// 接收方用同样的 secret 校验 X-Cowallet-Signature
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook 校验签名，并且签名时间和 now 相差不能超过 WebhookTimestampTolerance
+func VerifyWebhook(secret, signature, timestamp string, body []byte, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errWebhookSignature
+	}
+
+	if d := now.Sub(time.Unix(ts, 0)); d > WebhookTimestampTolerance || d < -WebhookTimestampTolerance {
+		return errWebhookSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(SignWebhook(secret, ts, body))) {
+		return errWebhookSignature
+	}
+
+	return nil
+}
+
+// enqueueWebhookEvent 给 vault 的每个 webhook 生成一条待投递记录，和触发事件的数据在同一个事务里保存
+func enqueueWebhookEvent(txn *badger.Txn, members []string, threshold uint8, typ string, data any) error {
+	webhooks, err := listWebhooks(txn, members, threshold)
+	if err != nil {
+		return err
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Now()
+	event := &WebhookEvent{
+		ID:        uuid.New(),
+		Type:      typ,
+		Vault:     mixin.RequireNewMixAddress(members, threshold).String(),
+		Data:      b,
+		CreatedAt: now,
+	}
+
+	for _, w := range webhooks {
+		d := &WebhookDelivery{
+			ID:            uuid.New(),
+			Webhook:       w.ID,
+			Event:         event,
+			State:         WebhookDeliveryStatePending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+
+		if err := saveDelivery(txn, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	errWebhookURL     = errors.New("invalid webhook url")
+	errWebhookAddress = errors.New("webhook address is not public")
+
+	// 运营商级 NAT 地址段，IsPrivate 不包含
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// isPublicAddr 排除回环、内网、链路本地等地址，避免 webhook 被用来访问内部服务
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() &&
+		ip.IsGlobalUnicast() &&
+		!ip.IsPrivate() &&
+		!ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// checkWebhookURL 创建 webhook 时解析域名，所有地址都必须是公网地址
+func checkWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errWebhookURL
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookURL, err)
+	}
+
+	for _, ip := range ips {
+		if !isPublicAddr(ip) {
+			return errWebhookAddress
+		}
+	}
+
+	return nil
+}
+
+// newWebhookClient 在建立连接时再检查一次地址，防止域名解析结果变化或者重定向到内网
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !isPublicAddr(addr.Addr()) {
+				return errWebhookAddress
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// 经过代理时检查不到真实的目标地址
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+	}
+}
+
+func postWebhook(ctx context.Context, client *http.Client, w *Webhook, d *WebhookDelivery) (int, error) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	// 每次投递都重新签名，重试的请求也不会因为时间戳过期被拒绝
+	ts := time.Now().Unix()
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(w.Secret, ts, body))
+	req.Header.Set(WebhookEventHeader, d.Event.Type)
+	req.Header.Set(WebhookDeliveryHeader, d.ID.String())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	if attempts >= 12 {
+		return webhookMaxBackoff
+	}
+
+	return min(time.Second<<attempts, webhookMaxBackoff)
+}
+
+func (s *Server) LoopWebhooks(ctx context.Context) error {
+	for {
+		_ = s.loopWebhooks(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) loopWebhooks(ctx context.Context) error {
+	txn := s.db.NewTransaction(false)
+	deliveries, err := listDueDeliveries(txn, time.Now(), 100)
+	txn.Discard()
+
+	if err != nil {
+		slog.Error("listDueDeliveries", "err", err)
+		return err
+	}
+
+	var g errgroup.Group
+	g.SetLimit(10)
+
+	for idx := range deliveries {
+		d := deliveries[idx]
+		g.Go(func() error {
+			return s.deliverWebhook(ctx, d)
+		})
+	}
+
+	return g.Wait()
+}
+
+func (s *Server) deliverWebhook(ctx context.Context, d *WebhookDelivery) error {
+	txn := s.db.NewTransaction(false)
+	w, err := findWebhook(txn, d.Webhook)
+	txn.Discard()
+
+	var code int
+	if err == nil {
+		code, err = postWebhook(ctx, s.webhooks, w, d)
+	} else if errors.Is(err, badger.ErrKeyNotFound) {
+		err = errors.New("webhook deleted")
+		d.Attempts = webhookMaxAttempts
+	} else {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		if err := dequeueDelivery(txn, d); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		d.Attempts++
+		d.StatusCode = code
+		d.UpdatedAt = now
+
+		if err == nil {
+			d.State = WebhookDeliveryStateDelivered
+			d.Error = ""
+		} else if d.Error = err.Error(); d.Attempts >= webhookMaxAttempts {
+			d.State = WebhookDeliveryStateFailed
+		} else {
+			d.NextAttemptAt = now.Add(webhookBackoff(d.Attempts))
+		}
+
+		return saveDelivery(txn, d)
+	})
+}
@@ -0,0 +1,202 @@
+package cowallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+func TestPostWebhook(t *testing.T) {
+	hook := &Webhook{
+		ID:     uuid.New(),
+		Secret: newWebhookSecret(),
+	}
+
+	d := &WebhookDelivery{
+		ID: uuid.New(),
+		Event: &WebhookEvent{
+			ID:        uuid.New(),
+			Type:      WebhookEventSnapshotCreated,
+			Data:      json.RawMessage(`{"amount":"1"}`),
+			CreatedAt: time.Now(),
+		},
+	}
+
+	var status = http.StatusOK
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhook(hook.Secret, r.Header.Get(WebhookSignatureHeader), r.Header.Get(WebhookTimestampHeader), body, time.Now()); err != nil {
+			t.Errorf("verify signature: %v", err)
+		}
+
+		if r.Header.Get(WebhookEventHeader) != WebhookEventSnapshotCreated {
+			t.Errorf("unexpected event header %q", r.Header.Get(WebhookEventHeader))
+		}
+
+		w.WriteHeader(status)
+	}))
+	defer svr.Close()
+
+	hook.URL = svr.URL
+	ctx := context.Background()
+
+	if code, err := postWebhook(ctx, svr.Client(), hook, d); err != nil || code != http.StatusOK {
+		t.Fatalf("post webhook: %d %v", code, err)
+	}
+
+	status = http.StatusInternalServerError
+	if code, err := postWebhook(ctx, svr.Client(), hook, d); err == nil || code != status {
+		t.Fatalf("expect error, got %d %v", code, err)
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	var (
+		secret = newWebhookSecret()
+		body   = []byte(`{"type":"snapshot.created"}`)
+		now    = time.Now()
+		ts     = now.Unix()
+		sig    = SignWebhook(secret, ts, body)
+	)
+
+	cases := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		now       time.Time
+		ok        bool
+	}{
+		{"valid", secret, strconv.FormatInt(ts, 10), body, now, true},
+		{"within tolerance", secret, strconv.FormatInt(ts, 10), body, now.Add(WebhookTimestampTolerance - time.Second), true},
+		{"replayed", secret, strconv.FormatInt(ts, 10), body, now.Add(WebhookTimestampTolerance + time.Second), false},
+		{"from the future", secret, strconv.FormatInt(ts, 10), body, now.Add(-WebhookTimestampTolerance - time.Second), false},
+		// 时间戳参与签名，改了时间戳签名就对不上
+		{"timestamp changed", secret, strconv.FormatInt(ts+1, 10), body, now, false},
+		{"body changed", secret, strconv.FormatInt(ts, 10), []byte(`{}`), now, false},
+		{"wrong secret", newWebhookSecret(), strconv.FormatInt(ts, 10), body, now, false},
+		{"invalid timestamp", secret, "now", body, now, false},
+	}
+
+	for _, c := range cases {
+		if err := VerifyWebhook(c.secret, sig, c.timestamp, c.body, c.now); (err == nil) != c.ok {
+			t.Errorf("%s: want ok %v, got %v", c.name, c.ok, err)
+		}
+	}
+}
+
+func TestSaveDeliveryTTL(t *testing.T) {
+	db := newTestDB(t)
+
+	d := &WebhookDelivery{
+		ID:            uuid.New(),
+		Webhook:       uuid.New(),
+		Event:         &WebhookEvent{ID: uuid.New(), Type: WebhookEventSnapshotCreated},
+		State:         WebhookDeliveryStatePending,
+		NextAttemptAt: time.Now(),
+		CreatedAt:     time.Now(),
+	}
+
+	expiresAt := func() (record, log uint64) {
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+
+		item, err := txn.Get(buildIndexKey(deliveryPrefix, d.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index, err := txn.Get(buildIndexKey(deliveryWebhookIndexPrefix, d.Webhook, d.CreatedAt.UnixNano(), d.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return item.ExpiresAt(), index.ExpiresAt()
+	}
+
+	save := func() {
+		if err := db.Update(func(txn *badger.Txn) error {
+			return saveDelivery(txn, d)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 还在投递的记录不会过期
+	save()
+	if record, log := expiresAt(); record != 0 || log != 0 {
+		t.Fatalf("pending delivery should not expire, got %d %d", record, log)
+	}
+
+	for _, state := range []string{WebhookDeliveryStateDelivered, WebhookDeliveryStateFailed} {
+		d.State = state
+		save()
+
+		record, log := expiresAt()
+		if record == 0 || log == 0 || time.Until(time.Unix(int64(record), 0)) > webhookDeliveryTTL {
+			t.Fatalf("%s delivery: want expiry within %s, got %d %d", state, webhookDeliveryTTL, record, log)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if d := webhookBackoff(1); d != 2*time.Second {
+		t.Errorf("unexpected backoff %s", d)
+	}
+
+	if d := webhookBackoff(30); d != webhookMaxBackoff {
+		t.Errorf("unexpected backoff %s", d)
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		url string
+		err error
+	}{
+		{"https://8.8.8.8/hook", nil},
+		{"ftp://8.8.8.8/hook", errWebhookURL},
+		{"http://127.0.0.1:8080/hook", errWebhookAddress},
+		{"http://10.0.0.1/hook", errWebhookAddress},
+		{"http://100.64.0.1/hook", errWebhookAddress},
+		{"http://169.254.169.254/latest/meta-data", errWebhookAddress},
+		{"http://[::1]/hook", errWebhookAddress},
+		{"http://[::ffff:127.0.0.1]/hook", errWebhookAddress},
+		{"http://[fd00::1]/hook", errWebhookAddress},
+		{"http://0.0.0.0/hook", errWebhookAddress},
+	}
+
+	for _, c := range cases {
+		if err := checkWebhookURL(ctx, c.url); !errors.Is(err, c.err) {
+			t.Errorf("%s: want %v, got %v", c.url, c.err, err)
+		}
+	}
+}
+
+func TestWebhookClientRejectsPrivateAddress(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not reach a loopback server")
+	}))
+	defer svr.Close()
+
+	resp, err := newWebhookClient().Get(svr.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expect error")
+	}
+
+	if !errors.Is(err, errWebhookAddress) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}